@@ -1,68 +1,492 @@
 package wspool
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
-// WsConn is an acquired conn from a Pool.
+// WsConn is an acquired conn from a Pool. Every acquisition returns its own
+// WsConn sharing the pooled connection, so that a holder that kept it past
+// its Release cannot release a later acquisition.
 type WsConn struct {
-	c          *websocket.Conn
-	p          *Pool
-	mu         sync.Mutex
-	createdAt  time.Time
+	*pooledConn
+	token uint64 // lease of the acquisition this handle was returned for
+}
+
+// pooledConn is the state of a pooled connection, shared by its handles.
+type pooledConn struct {
+	id        string
+	c         *websocket.Conn
+	p         *Pool
+	dialer    *websocket.Dialer
+	limiter   *Limiter // slot held until the socket is closed, or nil
+	url       string
+	target    string // sub-pool key; empty for the configured URL
+	mu        sync.Mutex
+	createdAt time.Time
+	// lastUsedAt is when the connection was last acquired, sent or read on,
+	// including while acquired; see pooledSince for time spent idle.
 	lastUsedAt time.Time
+	expiry     *time.Timer
+	retireAt   time.Time // LifetimeStagger slot, guarded by p.lock
+
+	// writeBufferSize is the size of the socket's write buffer.
+	writeBufferSize int
+	bytesSent       int64
+
+	// Messages buffered by SendMessage under CoalesceWindow.
+	pending    []string
+	flushTimer *time.Timer
+	flushErr   error
+
+	// skipped holds the messages read by an application ping while
+	// waiting for its pong, in arrival order, for the next reads.
+	skipped []skippedMessage
+
+	// broken marks the connection for close on release instead of reuse.
+	broken atomic.Bool
+
+	// evictReason is the EvictReason reported when a broken connection is
+	// closed on release, zero for EvictBroken.
+	evictReason atomic.Int32
+
+	// owner is the ID of the goroutine that acquired the connection when
+	// StrictOwnership is enabled, or zero.
+	owner atomic.Uint64
+
+	// uses counts how many times the connection has been acquired.
+	uses atomic.Int64
+
+	// lease is the token of the current acquisition, zero while idle.
+	lease atomic.Uint64
+
+	// leakTimer fires when the current acquisition exceeds
+	// MaxAcquireDuration, or is nil.
+	leakTimer atomic.Pointer[time.Timer]
+
+	// lastErr is the error of the last failed send or read, nil after a
+	// successful one.
+	lastErr atomic.Pointer[error]
+
+	// header holds the headers of the upgrade response, see HandshakeHeaders.
+	header atomic.Pointer[http.Header]
+
+	// readOnly rejects sends for the current acquisition, see SetReadOnly.
+	readOnly atomic.Bool
+
+	// sock mirrors c for CancelRead, which cannot wait for mu while a read
+	// holds it.
+	sock          atomic.Pointer[websocket.Conn]
+	readCancelled atomic.Bool
+
+	// pooledSince is when the connection was last released to the pool, in
+	// Unix nanoseconds, or zero if it never was; see PooledSince.
+	pooledSince atomic.Int64
+
+	// values holds application state, see SetValue.
+	values sync.Map
+
+	// subs lists the topics to restore on reconnect, see Subscribe. It has
+	// its own lock so that Subscriptions does not wait for a blocked read.
+	subsMu sync.Mutex
+	subs   []string
+
+	// Control frames observed by reads, see ControlStats.
+	pings  atomic.Int64
+	pongs  atomic.Int64
+	closes atomic.Int64
 }
 
-// SendMessage sends a text message over the WebSocket connection.
+// skippedMessage is a message read by appPing that was not the pong.
+type skippedMessage struct {
+	messageType int
+	data        []byte
+}
+
+// ControlStats counts the control frames received on a connection.
+type ControlStats struct {
+	// Pings is the number of ping frames received.
+	Pings int64
+	// Pongs is the number of pong frames received.
+	Pongs int64
+	// Closes is the number of close frames received.
+	Closes int64
+}
+
+// ErrNotOwner is returned by send and read methods when StrictOwnership is
+// enabled and the connection is used by a goroutine other than the one that
+// acquired it.
+var ErrNotOwner = errors.New("connection used by a goroutine that did not acquire it")
+
+// ErrReadCancelled is returned by a read that was unblocked by CancelRead.
+var ErrReadCancelled = errors.New("read cancelled")
+
+// ErrReconnectAbandoned is returned, wrapping the original error, when a
+// retriable error could not be recovered because every redial failed. The
+// connection is marked broken and is closed on release.
+var ErrReconnectAbandoned = errors.New("reconnect abandoned")
+
+// ErrConnClosed is returned by send and read methods, and by CancelRead,
+// once the connection's socket has been closed, whether by Close, by the
+// pool or by a failed liveness check.
+var ErrConnClosed = errors.New("connection is closed")
+
+// ErrReadOnly is returned by send methods on a connection marked read-only.
+var ErrReadOnly = errors.New("connection is read-only")
+
+// ID returns an identifier for the connection that is unique within its pool
+// and stable for the connection's lifetime, for correlating log lines.
+func (w *WsConn) ID() string {
+	return w.id
+}
+
+// PooledSince returns when the connection last entered the idle pool: when
+// it was last released, or when it was dialed if it was never released.
+// Unlike the time of the last send or read, it is not reset by operations
+// on an acquired connection, so it measures time spent idle in the pool and
+// drives MaxConnIdleTime eviction. While the connection is acquired it
+// reports the previous entry.
+func (w *WsConn) PooledSince() time.Time {
+	if ns := w.pooledSince.Load(); ns != 0 {
+		return time.Unix(0, ns)
+	}
+	return w.createdAt
+}
+
+// SetValue attaches application state, such as an auth token or session ID,
+// to the connection under key, for the connection's lifetime. Use
+// Config.TransferState to carry it over to replacement connections.
+func (w *WsConn) SetValue(key, value any) {
+	w.values.Store(key, value)
+}
+
+// Value returns the value attached to the connection under key with
+// SetValue, or nil.
+func (w *WsConn) Value(key any) any {
+	v, _ := w.values.Load(key)
+	return v
+}
+
+// ControlStats returns the number of control frames received so far.
+// Control frames are only processed while a read is in progress.
+func (w *WsConn) ControlStats() ControlStats {
+	return ControlStats{
+		Pings:  w.pings.Load(),
+		Pongs:  w.pongs.Load(),
+		Closes: w.closes.Load(),
+	}
+}
+
+// watchControlFrames wraps c's control frame handlers so that they count the
+// frames for ControlStats before running the handlers already installed.
+func (w *WsConn) watchControlFrames(c *websocket.Conn) {
+	ping, pong, closeFn := c.PingHandler(), c.PongHandler(), c.CloseHandler()
+	c.SetPingHandler(func(data string) error {
+		w.pings.Add(1)
+		return ping(data)
+	})
+	c.SetPongHandler(func(data string) error {
+		w.pongs.Add(1)
+		return pong(data)
+	})
+	c.SetCloseHandler(func(code int, text string) error {
+		w.closes.Add(1)
+		return closeFn(code, text)
+	})
+}
+
+// UsageCount returns how many times the connection has been acquired.
+func (w *WsConn) UsageCount() int64 {
+	return w.uses.Load()
+}
+
+// Subprotocol returns the subprotocol negotiated with the server, or an
+// empty string if none was.
+func (w *WsConn) Subprotocol() string {
+	if c := w.sock.Load(); c != nil {
+		return c.Subprotocol()
+	}
+	return ""
+}
+
+// setCompressionLevel applies the pool's CompressionLevel to c.
+func (w *WsConn) setCompressionLevel(c *websocket.Conn) {
+	if w.p == nil || w.p.config.CompressionLevel == 0 {
+		return
+	}
+	// The level was validated by New, so this cannot fail.
+	c.SetCompressionLevel(w.p.config.CompressionLevel)
+}
+
+// URL returns the URL the connection was dialed to.
+func (w *WsConn) URL() string {
+	return w.url
+}
+
+// SendMessage sends message over the WebSocket connection as a text frame,
+// or as the pool's configured DefaultMessageType.
 func (w *WsConn) SendMessage(message string) error {
+	_, err := w.SendMessageN(message)
+	return err
+}
+
+// SendMessageN is like SendMessage but also returns the number of payload
+// bytes written, which is zero if the write failed. Under CoalesceWindow it
+// is also zero for a message that was only buffered: nothing is written
+// until the flush, whose errors are reported by the next SendMessage or
+// Flush.
+func (w *WsConn) SendMessageN(message string) (int, error) {
+	if err := w.checkOwner(); err != nil {
+		return 0, err
+	}
+	defer w.acquireOp()()
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
 	if w.c == nil {
-		return errors.New("connection is nil")
+		return 0, ErrConnClosed
 	}
 	w.lastUsedAt = time.Now()
-	return w.c.WriteMessage(websocket.TextMessage, []byte(message))
+	if w.p != nil && w.p.config.CoalesceWindow > 0 {
+		return 0, w.coalesce(message)
+	}
+	if err := w.writeMessage(w.messageType(), []byte(message)); err != nil {
+		return 0, err
+	}
+	return len(message), nil
+}
+
+// coalesce buffers message for the next flush, arming the flush timer for the
+// first message of a batch. It reports the error of a previous timer flush.
+// Must be called with w.mu held.
+func (w *WsConn) coalesce(message string) error {
+	if w.readOnly.Load() {
+		return ErrReadOnly
+	}
+	if err := w.flushErr; err != nil {
+		w.flushErr = nil
+		return err
+	}
+	w.pending = append(w.pending, message)
+	if w.flushTimer == nil {
+		w.flushTimer = time.AfterFunc(w.p.config.CoalesceWindow, func() {
+			defer w.p.recoverPanic()
+			w.mu.Lock()
+			defer w.mu.Unlock()
+			w.flushErr = w.flush()
+		})
+	}
+	return nil
+}
+
+// Flush immediately sends the messages buffered by SendMessage under
+// CoalesceWindow as a single frame. It is called automatically when the
+// window elapses and when the connection is released.
+func (w *WsConn) Flush() error {
+	if err := w.checkOwner(); err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	err := w.flush()
+	if err == nil {
+		err, w.flushErr = w.flushErr, nil
+	}
+	return err
+}
+
+// flush writes the pending messages joined by newlines as one frame.
+// Must be called with w.mu held.
+func (w *WsConn) flush() error {
+	if w.flushTimer != nil {
+		w.flushTimer.Stop()
+		w.flushTimer = nil
+	}
+	if len(w.pending) == 0 {
+		return nil
+	}
+	data := []byte(strings.Join(w.pending, "\n"))
+	w.pending = nil
+	if w.c == nil {
+		return ErrConnClosed
+	}
+	return w.writeMessage(w.messageType(), data)
+}
+
+// acquireOp takes a slot of the pool-wide MaxConcurrentOps limit, blocking
+// until one is free, and returns the function that frees it again.
+func (w *WsConn) acquireOp() (release func()) {
+	if w.p == nil || w.p.ops == nil {
+		return func() {}
+	}
+	w.p.ops <- struct{}{}
+	return func() { <-w.p.ops }
+}
+
+// messageType returns the frame type used by SendMessage.
+func (w *WsConn) messageType() int {
+	if w.p == nil {
+		return websocket.TextMessage
+	}
+	return w.p.config.DefaultMessageType
 }
 
 // SendJSON sends a JSON-encoded message over the WebSocket connection.
 func (w *WsConn) SendJSON(v any) error {
+	if err := w.checkOwner(); err != nil {
+		return err
+	}
+	defer w.acquireOp()()
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
 	if w.c == nil {
-		return errors.New("connection is nil")
+		return ErrConnClosed
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
 	}
 	w.lastUsedAt = time.Now()
-	return w.c.WriteJSON(v)
+	return w.writeMessage(websocket.TextMessage, data)
+}
+
+// SendJSONDedup sends v as JSON unless a message with the same key was sent
+// through the pool, or its reader and writer sub-pools, within the
+// configured DedupWindow, which gives at-most-once delivery for callers that
+// retry. It reports whether the
+// message was sent. A failed send does not record the key, so it can be
+// retried.
+func (w *WsConn) SendJSONDedup(key string, v any) (bool, error) {
+	if w.p == nil {
+		return true, w.SendJSON(v)
+	}
+	if !w.p.root().dedupClaim(key) {
+		return false, nil
+	}
+	if err := w.SendJSON(v); err != nil {
+		w.p.root().dedupForget(key)
+		return false, err
+	}
+	return true, nil
+}
+
+// idempotentAttempts caps the attempts of SendJSONIdempotent, and
+// idempotentBackoff is the delay before the first retry, growing linearly.
+const (
+	idempotentAttempts = 3
+	idempotentBackoff  = 50 * time.Millisecond
+)
+
+// idempotentMessage is the envelope sent by SendJSONIdempotent.
+type idempotentMessage struct {
+	Key     string `json:"idempotencyKey"`
+	Payload any    `json:"payload"`
+}
+
+// SendJSONIdempotent sends v wrapped in an envelope carrying key, as
+// {"idempotencyKey": key, "payload": v}, so that the server can drop
+// duplicates. Sends that fail with an error the ErrorClassifier reports as
+// ErrorRetriable are retried with the same key, up to three attempts with a
+// short backoff. It gives up early with ctx's error once ctx ends.
+func (w *WsConn) SendJSONIdempotent(ctx context.Context, key string, v any) error {
+	if err := w.checkOwner(); err != nil {
+		return err
+	}
+	data, err := json.Marshal(idempotentMessage{Key: key, Payload: v})
+	if err != nil {
+		return err
+	}
+	for attempt := 1; ; attempt++ {
+		err = w.sendFrame(websocket.TextMessage, data)
+		if err == nil || attempt == idempotentAttempts || w.classify(err) != ErrorRetriable {
+			return err
+		}
+		select {
+		case <-time.After(time.Duration(attempt) * idempotentBackoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// SendJSONBatch sends each value in vs as its own JSON message while holding
+// the connection for the whole batch. Every message gets its own WriteTimeout
+// deadline, so one slow write cannot stall the batch indefinitely. The batch
+// is aborted on the first failed write and the connection is marked broken so
+// that it is closed on release. It returns the number of messages sent.
+func (w *WsConn) SendJSONBatch(vs []any) (int, error) {
+	if err := w.checkOwner(); err != nil {
+		return 0, err
+	}
+	defer w.acquireOp()()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.c == nil {
+		return 0, ErrConnClosed
+	}
+	for i, v := range vs {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return i, err
+		}
+		w.lastUsedAt = time.Now()
+		if err := w.writeMessage(websocket.TextMessage, data); err != nil {
+			w.markBroken(err)
+			return i, err
+		}
+	}
+	return len(vs), nil
 }
 
 // SendBinary sends a binary message over the WebSocket connection.
 func (w *WsConn) SendBinary(data []byte) error {
+	if err := w.checkOwner(); err != nil {
+		return err
+	}
+	return w.sendFrame(websocket.BinaryMessage, data)
+}
+
+// sendFrame sends data as a single message of messageType.
+func (w *WsConn) sendFrame(messageType int, data []byte) error {
+	defer w.acquireOp()()
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
 	if w.c == nil {
-		return errors.New("connection is nil")
+		return ErrConnClosed
 	}
 	w.lastUsedAt = time.Now()
-	return w.c.WriteMessage(websocket.BinaryMessage, data)
+	return w.writeMessage(messageType, data)
 }
 
 // ReadMessage reads a text message from the WebSocket connection.
 func (w *WsConn) ReadMessage() ([]byte, error) {
+	if err := w.checkOwner(); err != nil {
+		return nil, err
+	}
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
 	if w.c == nil {
-		return nil, errors.New("connection is nil")
+		return nil, ErrConnClosed
 	}
-	mt, data, err := w.c.ReadMessage()
+	mt, data, err := w.readMessage(w.readTimeout())
 	if err != nil {
 		return nil, err
 	}
@@ -75,13 +499,16 @@ func (w *WsConn) ReadMessage() ([]byte, error) {
 
 // ReadBinary reads a binary message from the WebSocket connection.
 func (w *WsConn) ReadBinary() ([]byte, error) {
+	if err := w.checkOwner(); err != nil {
+		return nil, err
+	}
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
 	if w.c == nil {
-		return nil, errors.New("connection is nil")
+		return nil, ErrConnClosed
 	}
-	mt, data, err := w.c.ReadMessage()
+	mt, data, err := w.readMessage(w.readTimeout())
 	if err != nil {
 		return nil, err
 	}
@@ -92,23 +519,398 @@ func (w *WsConn) ReadBinary() ([]byte, error) {
 	return data, nil
 }
 
+// ReadWithIdleTimeout reads the next text or binary message, failing with a
+// timeout error only if no message arrives within idle. Calling it in a loop
+// gives a stream an idle timeout that resets with every message received.
+// A timed out connection cannot be read again and is closed on release.
+func (w *WsConn) ReadWithIdleTimeout(idle time.Duration) ([]byte, error) {
+	if err := w.checkOwner(); err != nil {
+		return nil, err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.c == nil {
+		return nil, ErrConnClosed
+	}
+	_, data, err := w.readMessage(idle)
+	if err != nil {
+		return nil, err
+	}
+	w.lastUsedAt = time.Now()
+	return data, nil
+}
+
 // ReadJSON reads a JSON-encoded message from the WebSocket connection into v.
 func (w *WsConn) ReadJSON(v any) error {
+	if err := w.checkOwner(); err != nil {
+		return err
+	}
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
 	if w.c == nil {
-		return errors.New("connection is nil")
+		return ErrConnClosed
 	}
-	if err := w.c.ReadJSON(v); err != nil {
+	_, data, err := w.readMessage(w.readTimeout())
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
 		return err
 	}
 	w.lastUsedAt = time.Now()
 	return nil
 }
 
-// ping sends a WebSocket ping frame to verify the connection is alive.
-// On failure the underlying socket is closed. Updates lastUsedAt on success.
+// checkOwner reports ErrNotOwner when the pool enforces StrictOwnership and
+// the calling goroutine is not the one that acquired w.
+func (w *WsConn) checkOwner() error {
+	if w.p == nil || !w.p.config.StrictOwnership {
+		return nil
+	}
+	if owner := w.owner.Load(); owner != 0 && owner != goroutineID() {
+		return ErrNotOwner
+	}
+	return nil
+}
+
+// goroutineID returns the ID of the calling goroutine, parsed from the
+// "goroutine N [...]" header of its stack trace. It is only meant for
+// debugging aids such as StrictOwnership.
+func goroutineID() uint64 {
+	var buf [64]byte
+	n := runtime.Stack(buf[:], false)
+	fields := bytes.Fields(bytes.TrimPrefix(buf[:n], []byte("goroutine ")))
+	if len(fields) == 0 {
+		return 0
+	}
+	id, _ := strconv.ParseUint(string(fields[0]), 10, 64)
+	return id
+}
+
+// SetReadOnly marks the connection read-only for the current acquisition,
+// so that send methods return ErrReadOnly, for connections that only consume
+// a server push stream. Reads are unaffected. The mark is cleared when the
+// connection is released.
+func (w *WsConn) SetReadOnly(readOnly bool) {
+	w.readOnly.Store(readOnly)
+}
+
+// writeMessage passes one message through the SendInterceptor, sends it and
+// handles a failure according to the pool's ErrorClassifier.
+// Must be called with w.mu held and w.c non-nil.
+func (w *WsConn) writeMessage(messageType int, data []byte) error {
+	if w.readOnly.Load() {
+		return ErrReadOnly
+	}
+	if w.p != nil && w.p.config.SendInterceptor != nil {
+		var err error
+		if data, err = w.p.config.SendInterceptor(messageType, data); err != nil {
+			return err
+		}
+	}
+	return w.do(func() error { return w.send(messageType, data) })
+}
+
+// readMessage receives one message, handles a failure according to the
+// pool's ErrorClassifier and passes the message to inspect.
+// Must be called with w.mu held and w.c non-nil.
+func (w *WsConn) readMessage(timeout time.Duration) (messageType int, data []byte, err error) {
+	// The read holds w.mu until a message arrives, so the flush timer could
+	// not send a coalesced request the peer must see before it replies.
+	if err = w.flush(); err != nil {
+		return 0, nil, err
+	}
+	err = w.do(func() (err error) {
+		messageType, data, err = w.receive(timeout)
+		return err
+	})
+	if err != nil {
+		return messageType, data, err
+	}
+	data, err = w.inspect(messageType, data)
+	return messageType, data, err
+}
+
+// inspect passes a received message through the ReceiveInterceptor and
+// MessageValidator. A validation error marks the connection broken if the
+// ErrorClassifier says so.
+func (w *WsConn) inspect(messageType int, data []byte) ([]byte, error) {
+	if w.p == nil {
+		return data, nil
+	}
+	if w.p.config.ReceiveInterceptor != nil {
+		var err error
+		if data, err = w.p.config.ReceiveInterceptor(messageType, data); err != nil {
+			return nil, err
+		}
+	}
+	if w.p.config.MessageValidator != nil {
+		if err := w.p.config.MessageValidator(data); err != nil {
+			if w.classify(err) == ErrorBroken {
+				w.markBroken(err)
+			}
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// do runs op, a send or receive on w.c, and classifies its error. Broken
+// connections are marked for close on release; on a retriable error the
+// socket is redialed and op is retried once. If every redial fails, the
+// connection is marked broken and ErrReconnectAbandoned is returned.
+// Must be called with w.mu held and w.c non-nil.
+func (w *WsConn) do(op func() error) error {
+	err := op()
+	defer func() { w.setLastError(err) }()
+	if err == nil {
+		return nil
+	}
+	switch w.classify(err) {
+	case ErrorBroken:
+		w.markBroken(err)
+	case ErrorRetriable:
+		if rerr := w.reconnect(); rerr != nil {
+			err = fmt.Errorf("%w (%v): %w", ErrReconnectAbandoned, rerr, err)
+			w.p.reportError(err)
+			w.markBroken(err)
+			return err
+		}
+		if err = op(); err != nil && w.classify(err) != ErrorSurface {
+			w.markBroken(err)
+		}
+	}
+	return err
+}
+
+// HandshakeHeaders returns the HTTP headers of the server's upgrade response
+// for the current socket, such as session IDs or feature flags. It is
+// updated when the connection is redialed. The returned header must not be
+// modified.
+func (w *WsConn) HandshakeHeaders() http.Header {
+	if h := w.header.Load(); h != nil {
+		return *h
+	}
+	return nil
+}
+
+func (w *WsConn) setHandshakeHeaders(resp *http.Response) {
+	if resp == nil {
+		w.header.Store(nil)
+		return
+	}
+	w.header.Store(&resp.Header)
+}
+
+// LastError returns the error of the last failed send or read on the
+// connection, or nil if the last operation succeeded. It explains why a
+// connection became broken.
+func (w *WsConn) LastError() error {
+	if err := w.lastErr.Load(); err != nil {
+		return *err
+	}
+	return nil
+}
+
+func (w *WsConn) setLastError(err error) {
+	if err == nil {
+		w.lastErr.Store(nil)
+		return
+	}
+	w.lastErr.Store(&err)
+}
+
+// markBroken marks the connection broken because of err and, the first time,
+// reports it to the pool's OnConnError hook on a separate goroutine.
+func (w *WsConn) markBroken(err error) {
+	w.setLastError(err)
+	if w.broken.Swap(true) {
+		return
+	}
+	if w.p != nil && w.p.config.OnConnError != nil {
+		go func() {
+			defer w.p.recoverPanic()
+			w.p.config.OnConnError(w, err)
+		}()
+	}
+}
+
+// classify applies the pool's ErrorClassifier, or DefaultErrorClassifier.
+func (w *WsConn) classify(err error) ErrorKind {
+	// Classifiers predate CloseError and check for the websocket package's
+	// own error type.
+	if closeErr, ok := err.(*CloseError); ok {
+		err = closeErr.err
+	}
+	if w.p != nil && w.p.config.ErrorClassifier != nil {
+		return w.p.config.ErrorClassifier(err)
+	}
+	return DefaultErrorClassifier(err)
+}
+
+// defaultWriteBufferSize is the websocket package's default write buffer
+// size, used when the dialer does not set one.
+const defaultWriteBufferSize = 4096
+
+// writeBufferSize returns the write buffer size of connections dialed with
+// dialer.
+func writeBufferSize(dialer *websocket.Dialer) int {
+	if dialer.WriteBufferSize > 0 {
+		return dialer.WriteBufferSize
+	}
+	return defaultWriteBufferSize
+}
+
+// reconnect replaces the socket with a fresh connection to the same URL,
+// trying up to MaxReconnectAttempts dials. OnNewConn is not run on the new
+// socket, since it would need w.mu; only subscriptions are restored.
+// Must be called with w.mu held.
+func (w *WsConn) reconnect() error {
+	if w.p == nil {
+		return errors.New("connection does not belong to a pool")
+	}
+	c, resp, _, err := dial(w.dialer, w.url, w.p.config.FollowRedirects)
+	for i := 1; err != nil && i < w.p.config.MaxReconnectAttempts; i++ {
+		c, resp, _, err = dial(w.dialer, w.url, w.p.config.FollowRedirects)
+	}
+	if err != nil {
+		return err
+	}
+	w.setHandshakeHeaders(resp)
+	if w.c != nil {
+		w.c.Close()
+	}
+	w.watchControlFrames(c)
+	w.setCompressionLevel(c)
+	w.c = c
+	w.sock.Store(c)
+	w.readCancelled.Store(false)
+	return w.restoreSubscriptions()
+}
+
+// send writes one message under the configured write timeout and
+// DefaultWriteContext, and counts the bytes sent towards MaxConnBytes. The
+// deadline is always cleared afterwards so that it cannot leak into the next
+// write.
+// Must be called with w.mu held and w.c non-nil.
+func (w *WsConn) send(messageType int, data []byte) error {
+	var ctx context.Context
+	if w.p != nil && w.p.config.DefaultWriteContext != nil {
+		ctx = w.p.config.DefaultWriteContext()
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+	var deadline time.Time
+	if w.p != nil && w.p.config.WriteTimeout > 0 {
+		deadline = time.Now().Add(w.p.config.WriteTimeout)
+	}
+	if ctx != nil {
+		if d, ok := ctx.Deadline(); ok && (deadline.IsZero() || d.Before(deadline)) {
+			deadline = d
+		}
+	}
+	if !deadline.IsZero() {
+		w.c.SetWriteDeadline(deadline)
+	}
+	var err error
+	if ctx != nil {
+		err = w.writeWithContext(ctx, messageType, data)
+	} else {
+		err = w.c.WriteMessage(messageType, data)
+	}
+	w.c.SetWriteDeadline(time.Time{})
+	if err != nil {
+		return err
+	}
+
+	w.bytesSent += int64(len(data))
+	if w.p != nil && w.p.config.MaxConnBytes > 0 && w.bytesSent >= w.p.config.MaxConnBytes {
+		// Retired like a connection past its lifetime, not as a failure.
+		w.evictReason.CompareAndSwap(0, int32(EvictExpired))
+		w.broken.Store(true)
+	}
+	return nil
+}
+
+// writeWithContext writes one message, interrupting the write when ctx is
+// cancelled. The error then wraps both ctx's error and the write error.
+// Must be called with w.mu held and w.c non-nil.
+func (w *WsConn) writeWithContext(ctx context.Context, messageType int, data []byte) error {
+	c := w.c
+	interrupted := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		defer close(interrupted)
+		// The websocket.Conn deadline is not safe to set during a write, so
+		// expire the underlying socket's deadline instead.
+		c.NetConn().SetWriteDeadline(time.Now())
+	})
+	err := c.WriteMessage(messageType, data)
+	if !stop() {
+		// Wait for the interrupt so that it cannot outlive this write.
+		<-interrupted
+	}
+	if err != nil && ctx.Err() != nil {
+		return fmt.Errorf("%w: %w", ctx.Err(), err)
+	}
+	return err
+}
+
+// readTimeout returns the configured ReadTimeout.
+func (w *WsConn) readTimeout() time.Duration {
+	if w.p == nil {
+		return 0
+	}
+	return w.p.config.ReadTimeout
+}
+
+// receive reads one message, failing if none arrives within timeout when it
+// is positive. The deadline is always cleared afterwards so that it cannot
+// leak into the next read. A close by the peer is returned as a *CloseError.
+// Must be called with w.mu held and w.c non-nil.
+func (w *WsConn) receive(timeout time.Duration) (int, []byte, error) {
+	if w.readCancelled.Swap(false) {
+		return 0, nil, ErrReadCancelled
+	}
+	if len(w.skipped) > 0 {
+		m := w.skipped[0]
+		w.skipped = w.skipped[1:]
+		return m.messageType, m.data, nil
+	}
+	if timeout > 0 {
+		w.c.SetReadDeadline(time.Now().Add(timeout))
+	}
+	mt, data, err := w.c.ReadMessage()
+	w.c.SetReadDeadline(time.Time{})
+	if err != nil && w.readCancelled.Swap(false) {
+		return 0, nil, ErrReadCancelled
+	}
+	return mt, data, asCloseError(err)
+}
+
+// CancelRead unblocks a read in progress on w by moving its read deadline
+// into the past; the read returns ErrReadCancelled. If no read is in
+// progress, the next read is cancelled instead. It is safe to call from any
+// goroutine.
+//
+// The socket is not closed and sends keep working, but gorilla/websocket
+// fails every read after an interrupted one, so the connection is marked
+// broken and closed on release.
+func (w *WsConn) CancelRead() error {
+	c := w.sock.Load()
+	if c == nil {
+		return ErrConnClosed
+	}
+	w.broken.Store(true)
+	w.readCancelled.Store(true)
+	return c.SetReadDeadline(time.Now())
+}
+
+// ping sends a WebSocket ping frame to verify the connection is alive before
+// it is handed out, and updates lastUsedAt. On failure the underlying socket
+// is closed.
 // Must be called without p.lock held: ping acquires w.mu, and the lock
 // ordering rule is p.lock → w.mu — never the reverse.
 func (w *WsConn) ping() bool {
@@ -119,52 +921,177 @@ func (w *WsConn) ping() bool {
 		return false
 	}
 	if err := w.c.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second)); err != nil {
-		w.c.Close()
-		w.c = nil
+		w.closeSocket()
 		return false
 	}
 	w.lastUsedAt = time.Now()
 	return true
 }
 
+// verify is ping with the pool's AppPingMessage, for the health check. On
+// failure the underlying socket is closed.
+// Must be called without p.lock held.
+func (w *WsConn) verify() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.c == nil {
+		return false
+	}
+	if !w.appPing() {
+		w.closeSocket()
+		return false
+	}
+	return true
+}
+
+// appPing sends the pool's AppPingMessage and waits for a reply accepted by
+// AppPongMatcher. Other messages read meanwhile are queued for the next
+// read.
+// Must be called with w.mu held and w.c non-nil.
+func (w *WsConn) appPing() bool {
+	timeout := w.readTimeout()
+	if timeout <= 0 {
+		timeout = time.Second
+	}
+	deadline := time.Now().Add(timeout)
+	w.c.SetWriteDeadline(deadline)
+	err := w.c.WriteMessage(w.messageType(), w.p.config.AppPingMessage)
+	w.c.SetWriteDeadline(time.Time{})
+	if err != nil {
+		return false
+	}
+	w.c.SetReadDeadline(deadline)
+	defer w.c.SetReadDeadline(time.Time{})
+	for {
+		mt, data, err := w.c.ReadMessage()
+		if err != nil {
+			return false
+		}
+		if w.p.config.AppPongMatcher(data) {
+			return true
+		}
+		w.skipped = append(w.skipped, skippedMessage{messageType: mt, data: data})
+	}
+}
+
 // disconnect closes the underlying socket without touching pool state.
 // Pool methods use this when they already hold p.lock and manage activeConnections themselves.
-func (w *WsConn) disconnect() {
+func (w *WsConn) disconnect() error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
-	if w.c != nil {
-		w.c.Close()
-		w.c = nil
+	w.stopExpiry()
+	if w.c == nil {
+		return nil
+	}
+	return w.closeSocket()
+}
+
+// closeSocket closes w.c for good, gives up its Limiter slot and records the
+// retirement in the pool's Stats.
+// Must be called with w.mu held and w.c non-nil.
+func (w *WsConn) closeSocket() error {
+	err := w.c.Close()
+	w.c = nil
+	w.sock.Store(nil)
+	if w.limiter != nil {
+		w.limiter.release()
+		w.limiter = nil
+	}
+	if w.p != nil {
+		w.p.recordRetirement(w.uses.Load())
+	}
+	return err
+}
+
+// stopExpiry cancels the lifetime timer, if any.
+func (w *WsConn) stopExpiry() {
+	if w.expiry != nil {
+		w.expiry.Stop()
 	}
 }
 
 // Close closes the underlying connection and removes it from the pool.
+// Closing an already closed connection is a no-op and returns nil.
+func (w *WsConn) Close() error {
+	return w.close(nil)
+}
+
+// CloseWithStatus sends a close frame with the given status code and text
+// to the peer, then closes the connection like Close.
+func (w *WsConn) CloseWithStatus(code int, text string) error {
+	return w.close(websocket.FormatCloseMessage(code, text))
+}
+
+// close writes frame as a close message when non-nil and closes the socket.
+// Errors reporting that the connection is already closing are swallowed so
+// that redundant closes succeed.
 // w.mu is released before p.lock is acquired to preserve lock ordering:
 // pool internals always acquire p.lock then w.mu (via disconnect),
 // never the reverse.
-func (w *WsConn) Close() error {
+func (w *WsConn) close(frame []byte) error {
 	w.mu.Lock()
 	if w.c == nil {
 		w.mu.Unlock()
-		return errors.New("connection is nil")
+		return nil
+	}
+	var err error
+	if frame != nil {
+		err = w.c.WriteControl(websocket.CloseMessage, frame, time.Now().Add(time.Second))
+	}
+	w.stopExpiry()
+	if cerr := w.closeSocket(); err == nil {
+		err = cerr
 	}
-	err := w.c.Close()
-	w.c = nil
 	w.mu.Unlock()
+	w.lease.Store(0)
 
 	if w.p != nil {
 		w.p.lock.Lock()
 		w.p.activeConnections--
 		w.p.lock.Unlock()
 	}
+	if isAlreadyClosed(err) {
+		return nil
+	}
 	return err
 }
 
+// isAlreadyClosed reports whether err only signals that the connection was
+// already closing or closed.
+func isAlreadyClosed(err error) bool {
+	return errors.Is(err, websocket.ErrCloseSent) || errors.Is(err, net.ErrClosed)
+}
+
 // Release returns w to the pool it was acquired from.
-// The caller must not use w after calling Release.
+// The caller must not use w after calling Release. Releasing a connection
+// that was already released or closed is a no-op, and so is releasing w
+// after the connection was acquired again: the WsConn returned by that
+// acquisition holds the new lease.
 func (w *WsConn) Release() {
-	if w.p == nil {
+	w.ReleaseLease(w.token)
+}
+
+// Lease returns the token of the current acquisition of w, or zero if w is
+// not acquired. Every Acquire hands out a new token.
+func (w *WsConn) Lease() uint64 {
+	return w.lease.Load()
+}
+
+// ReleaseLease returns w to the pool only if token is still its current
+// lease. A holder that kept w past its own Release cannot give the connection
+// back on behalf of a later acquirer: the stale release is ignored.
+func (w *WsConn) ReleaseLease(token uint64) {
+	if w.p == nil || token == 0 || !w.lease.CompareAndSwap(token, 0) {
 		return
 	}
+	if t := w.leakTimer.Load(); t != nil {
+		t.Stop()
+	}
+	w.pooledSince.Store(time.Now().UnixNano())
+	w.mu.Lock()
+	w.flush()
+	w.flushErr = nil
+	w.mu.Unlock()
 	w.p.release(w)
 }
@@ -0,0 +1,56 @@
+package wspool
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+
+	"github.com/gorilla/websocket"
+)
+
+// dial dials rawURL with dialer, following up to redirects redirect
+// responses to the upgrade request. It returns the URL finally dialed.
+func dial(dialer *websocket.Dialer, rawURL string, redirects int) (*websocket.Conn, *http.Response, string, error) {
+	for {
+		conn, resp, err := dialer.Dial(rawURL, nil)
+		if err == nil || redirects <= 0 || !errors.Is(err, websocket.ErrBadHandshake) || resp == nil {
+			return conn, resp, rawURL, err
+		}
+		switch resp.StatusCode {
+		case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+			http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		default:
+			return conn, resp, rawURL, err
+		}
+		next, lerr := redirectURL(rawURL, resp.Header.Get("Location"))
+		if lerr != nil {
+			return nil, resp, rawURL, lerr
+		}
+		rawURL = next
+		redirects--
+	}
+}
+
+// redirectURL resolves the Location of a redirect response against the URL
+// that was dialed, mapping HTTP schemes to their WebSocket equivalents.
+func redirectURL(base, location string) (string, error) {
+	if location == "" {
+		return "", errors.New("redirect without Location header")
+	}
+	b, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+	loc, err := url.Parse(location)
+	if err != nil {
+		return "", err
+	}
+	u := b.ResolveReference(loc)
+	switch u.Scheme {
+	case "http":
+		u.Scheme = "ws"
+	case "https":
+		u.Scheme = "wss"
+	}
+	return u.String(), nil
+}
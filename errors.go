@@ -0,0 +1,78 @@
+package wspool
+
+import (
+	"errors"
+	"io"
+	"net"
+
+	"github.com/gorilla/websocket"
+)
+
+// ErrorKind tells a connection how to treat an error from a send or read.
+type ErrorKind int
+
+const (
+	// ErrorSurface returns the error to the caller and keeps the connection
+	// in service.
+	ErrorSurface ErrorKind = iota
+	// ErrorBroken returns the error and marks the connection broken, so it is
+	// closed on release instead of being reused.
+	ErrorBroken
+	// ErrorRetriable redials the connection in place and retries the
+	// operation once before returning.
+	ErrorRetriable
+)
+
+// DefaultErrorClassifier is used when Config.ErrorClassifier is nil. Close
+// frames, closed or cancelled sockets, unexpected EOFs and network errors
+// break the connection; any other error is surfaced as-is.
+func DefaultErrorClassifier(err error) ErrorKind {
+	var closeErr *websocket.CloseError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &closeErr),
+		errors.As(err, &netErr),
+		errors.Is(err, websocket.ErrCloseSent),
+		errors.Is(err, net.ErrClosed),
+		errors.Is(err, io.EOF),
+		errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, ErrReadCancelled):
+		return ErrorBroken
+	}
+	return ErrorSurface
+}
+
+// CloseError is returned by reads when the peer closed the connection, so
+// that callers can branch on the close code. Abnormal closures without a
+// close frame are reported with code websocket.CloseAbnormalClosure (1006).
+// It unwraps to the underlying *websocket.CloseError.
+type CloseError struct {
+	Code int
+	Text string
+
+	err error
+}
+
+func (e *CloseError) Error() string {
+	return e.err.Error()
+}
+
+func (e *CloseError) Unwrap() error {
+	return e.err
+}
+
+// Normal reports whether the connection was closed normally, with code 1000
+// (normal closure) or 1001 (going away).
+func (e *CloseError) Normal() bool {
+	return e.Code == websocket.CloseNormalClosure || e.Code == websocket.CloseGoingAway
+}
+
+// asCloseError converts a close error from the websocket package into a
+// *CloseError and returns any other error unchanged.
+func asCloseError(err error) error {
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) {
+		return &CloseError{Code: closeErr.Code, Text: closeErr.Text, err: err}
+	}
+	return err
+}
@@ -0,0 +1,51 @@
+package wspool
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrLimitReached is returned by Acquire when a new connection is needed but
+// the pool's shared Limiter has no free slot. Acquire does not wait for a
+// slot, since it may be held by another pool.
+var ErrLimitReached = errors.New("shared connection limit reached")
+
+// Limiter caps the total number of open connections across all pools that
+// share it through Config.Limiter, to protect the host when a service runs
+// one pool per endpoint. Every connection holds a slot from the moment it is
+// dialed until it is closed.
+type Limiter struct {
+	mu   sync.Mutex
+	max  int
+	open int
+}
+
+// NewLimiter returns a Limiter allowing max open connections.
+func NewLimiter(max int) *Limiter {
+	return &Limiter{max: max}
+}
+
+// Open returns the number of connections currently holding a slot.
+func (l *Limiter) Open() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.open
+}
+
+// acquire takes a slot if one is free and reports whether it did.
+func (l *Limiter) acquire() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.open >= l.max {
+		return false
+	}
+	l.open++
+	return true
+}
+
+// release returns a slot taken by acquire.
+func (l *Limiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.open--
+}
@@ -0,0 +1,324 @@
+package wspool
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ErrStreamClosed is returned by Stream methods after the stream was closed
+// or its shared connection failed.
+var ErrStreamClosed = errors.New("stream is closed")
+
+// muxMessage is the frame that carries one message of a Stream.
+type muxMessage struct {
+	Stream string `json:"stream"`
+	Data   string `json:"data"`
+}
+
+// Stream is a logical stream multiplexed with others over one shared
+// connection, see Pool.OpenStream. Its methods are safe for concurrent use.
+type Stream struct {
+	id string
+	m  *mux
+
+	mu     sync.Mutex
+	queue  [][]byte
+	notify chan struct{} // signalled when queue grows or the stream closes
+	err    error         // set once the stream is closed
+}
+
+// mux shares one acquired connection between Streams: a single reader
+// demultiplexes incoming frames by stream ID and writes are serialized by
+// the connection's lock.
+type mux struct {
+	p    *Pool
+	conn *WsConn
+
+	mu      sync.Mutex
+	streams map[string]*Stream
+	lastID  uint64
+	err     error // why the reader stopped
+}
+
+// OpenStream opens a logical stream over the pool's shared multiplexed
+// connection, for servers that prefer one socket carrying many streams. The
+// first stream acquires a connection and dedicates it to multiplexing; later
+// streams share it until the last one is closed, when the connection is
+// closed and returned. Each message travels as a JSON text frame
+// {"stream": id, "data": message}, and frames from the server are routed to
+// the stream with the matching ID; frames for unknown streams are dropped.
+func (p *Pool) OpenStream(ctx context.Context) (*Stream, error) {
+	p.muxLock.Lock()
+	defer p.muxLock.Unlock()
+	if m := p.mux; m != nil {
+		if s := m.open(); s != nil {
+			return s, nil
+		}
+		// The shared connection failed; start over on a new one.
+		p.mux = nil
+	}
+	conn, err := p.acquireConn(ctx, "", p.config.SaturationPolicy)
+	if err != nil {
+		return nil, err
+	}
+	conn = p.checkout(conn)
+	m := &mux{
+		p:       p,
+		conn:    conn,
+		streams: make(map[string]*Stream),
+	}
+	p.mux = m
+	go m.read()
+	return m.open(), nil
+}
+
+// open registers a new stream, or returns nil if the mux has stopped.
+func (m *mux) open() *Stream {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return nil
+	}
+	m.lastID++
+	s := &Stream{
+		id:     strconv.FormatUint(m.lastID, 10),
+		m:      m,
+		notify: make(chan struct{}, 1),
+	}
+	m.streams[s.id] = s
+	return s
+}
+
+// read demultiplexes frames until the connection fails, the pool is closed
+// or the last stream is closed, then fails the remaining streams and
+// releases the connection.
+func (m *mux) read() {
+	stopped := make(chan struct{})
+	defer func() {
+		close(stopped)
+		m.conn.Release()
+	}()
+	defer m.stop(ErrStreamClosed)
+	defer m.p.recoverPanic()
+	go func() {
+		select {
+		case <-m.p.closeChan:
+			m.conn.CancelRead()
+		case <-stopped:
+		}
+	}()
+
+	for {
+		data, err := m.receive()
+		if err != nil {
+			m.conn.markBroken(err)
+			m.stop(err)
+			return
+		}
+		var msg muxMessage
+		if json.Unmarshal(data, &msg) != nil {
+			continue
+		}
+		m.mu.Lock()
+		s := m.streams[msg.Stream]
+		m.mu.Unlock()
+		if s != nil {
+			s.push([]byte(msg.Data))
+		}
+	}
+}
+
+// stop fails every open stream with err, unless the mux already stopped.
+func (m *mux) stop(err error) {
+	m.mu.Lock()
+	if m.err != nil {
+		m.mu.Unlock()
+		return
+	}
+	m.err = err
+	streams := m.streams
+	m.streams = nil
+	m.mu.Unlock()
+	for _, s := range streams {
+		s.close(err)
+	}
+}
+
+// write sends msg as one frame through the connection's normal send path,
+// so that it honours the SendInterceptor, MaxConcurrentOps, MaxConnBytes and
+// DefaultWriteContext, and may redial the connection. If the connection
+// breaks, the reader is stopped so that every stream fails.
+func (m *mux) write(msg muxMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	err = m.conn.sendFrame(websocket.TextMessage, data)
+	if err != nil && m.conn.broken.Load() {
+		m.conn.CancelRead()
+	}
+	return err
+}
+
+// receive reads the next text frame. Unlike ReadMessage it does not hold the
+// connection's lock while waiting, so that streams can send meanwhile;
+// gorilla/websocket allows one reader concurrently with one writer. If a send
+// redialed the connection during the wait, reading resumes on the new
+// socket, and a retriable read error redials it here.
+func (m *mux) receive() ([]byte, error) {
+	w := m.conn
+	for {
+		w.mu.Lock()
+		c := w.c
+		if c == nil {
+			w.mu.Unlock()
+			return nil, ErrConnClosed
+		}
+		if w.readCancelled.Swap(false) {
+			w.mu.Unlock()
+			return nil, ErrReadCancelled
+		}
+		if len(w.skipped) > 0 {
+			msg := w.skipped[0]
+			w.skipped = w.skipped[1:]
+			w.mu.Unlock()
+			return m.accept(msg.messageType, msg.data)
+		}
+		w.mu.Unlock()
+
+		mt, data, err := c.ReadMessage()
+		if err == nil {
+			return m.accept(mt, data)
+		}
+
+		w.mu.Lock()
+		if w.readCancelled.Swap(false) {
+			err = ErrReadCancelled
+		} else if w.c != c && w.c != nil {
+			// A send replaced the socket; read from the new one.
+			w.mu.Unlock()
+			continue
+		} else {
+			err = asCloseError(err)
+		}
+		w.setLastError(err)
+		if err != ErrReadCancelled && w.classify(err) == ErrorRetriable && w.reconnect() == nil {
+			w.mu.Unlock()
+			continue
+		}
+		w.mu.Unlock()
+		return nil, err
+	}
+}
+
+// accept passes a received frame to inspect, rejecting non-text frames.
+func (m *mux) accept(mt int, data []byte) ([]byte, error) {
+	if mt != websocket.TextMessage {
+		return nil, fmt.Errorf("expected text frame, got %d", mt)
+	}
+	data, err := m.conn.inspect(mt, data)
+	if err != nil {
+		return nil, err
+	}
+	m.conn.mu.Lock()
+	m.conn.lastUsedAt = time.Now()
+	m.conn.mu.Unlock()
+	return data, nil
+}
+
+// remove forgets s and, once no stream is left, retires the mux and stops
+// its reader so that the connection is closed and returned.
+func (m *mux) remove(s *Stream) {
+	m.p.muxLock.Lock()
+	defer m.p.muxLock.Unlock()
+	m.mu.Lock()
+	delete(m.streams, s.id)
+	last := m.err == nil && len(m.streams) == 0
+	m.mu.Unlock()
+	if last && m.p.mux == m {
+		m.p.mux = nil
+		m.conn.CancelRead()
+	}
+}
+
+// ID returns the stream's identifier, unique within its shared connection.
+func (s *Stream) ID() string {
+	return s.id
+}
+
+// Send sends message on the stream.
+func (s *Stream) Send(message string) error {
+	s.mu.Lock()
+	err := s.err
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return s.m.write(muxMessage{Stream: s.id, Data: message})
+}
+
+// Receive returns the next message sent to the stream, waiting until one
+// arrives, the stream is closed or ctx ends. Messages that arrived before
+// the stream was closed are still returned.
+func (s *Stream) Receive(ctx context.Context) ([]byte, error) {
+	for {
+		s.mu.Lock()
+		if len(s.queue) > 0 {
+			data := s.queue[0]
+			s.queue = s.queue[1:]
+			s.mu.Unlock()
+			return data, nil
+		}
+		err := s.err
+		s.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		select {
+		case <-s.notify:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Close closes the stream. Closing the last open stream closes the shared
+// connection. Close is idempotent.
+func (s *Stream) Close() error {
+	s.close(ErrStreamClosed)
+	s.m.remove(s)
+	return nil
+}
+
+// push queues an incoming message. The queue is unbounded so that a slow
+// stream cannot stall the others.
+func (s *Stream) push(data []byte) {
+	s.mu.Lock()
+	s.queue = append(s.queue, data)
+	s.mu.Unlock()
+	s.signal()
+}
+
+// close fails future calls with err, unless the stream is already closed.
+func (s *Stream) close(err error) {
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.mu.Unlock()
+	s.signal()
+}
+
+func (s *Stream) signal() {
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
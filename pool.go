@@ -1,9 +1,22 @@
 package wspool
 
 import (
+	"compress/flate"
 	"context"
 	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"math"
+	"os"
+	"os/signal"
+	"runtime/debug"
+	"slices"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -11,16 +24,57 @@ import (
 
 // Pool manages a pool of reusable WebSocket connections.
 type Pool struct {
-	conns             []*WsConn
+	idle              idleStore
 	config            *Config
 	lock              sync.Mutex
+	batchLock         sync.Mutex
 	activeConnections int32
 	closed            bool
-	waiters           []chan *WsConn
+	waiters           []*waiter
+	drained           map[string]time.Time
+	counters          counters
+	lastID            atomic.Uint64 // last connection ID, see prepareDial
+	parent            *Pool         // owning pool of a role sub-pool, or nil
+	lastLease         atomic.Uint64
 	closeOnce         sync.Once
 	closeChan         chan struct{}
+	resumeChan        chan struct{}
+	healthPaused      bool
+	healthPeriod      time.Duration
+	sawActivity       bool
+	ops               chan struct{}
+	wrr               []int     // smooth weighted round-robin state for URLs
+	nextRetire        time.Time // next free LifetimeStagger slot
+	anyMessages       chan anyMessage
+	anyReaders        int
+	readers, writers  *Pool // role sub-pools, see Config.MaxReaders
+	errs              chan error
+	pendingDials      int           // dials in flight, see Config.MaxPendingDials
+	saturated         bool          // MaxConn reached, see Config.OnMaxConnReached
+	dialDone          chan struct{} // closed when a pending dial finishes
+	predecessors      []*WsConn     // retired connections awaiting TransferState
+	dedupLock         sync.Mutex
+	dedup             map[string]time.Time // send time of SendJSONDedup keys
+	dedupOrder        []dedupEntry         // dedup keys, oldest first
+	muxLock           sync.Mutex
+	mux               *mux       // shared connection of OpenStream, or nil
+	errsLock          sync.Mutex // makes drop-oldest in reportError atomic
+
+	// Retirement counters for Stats. They are updated when a socket is
+	// closed, which can happen without p.lock held.
+	retired     atomic.Int64
+	retiredUses atomic.Int64
 }
 
+// errorsBuffer is the capacity of the Errors channel.
+const errorsBuffer = 64
+
+// defaultDrainTimeout is used when Config.DrainTimeout is zero.
+const defaultDrainTimeout = 100 * time.Millisecond
+
+// defaultDedupWindow is used when Config.DedupWindow is zero.
+const defaultDedupWindow = time.Minute
+
 // Stats holds a snapshot of pool health at the time of the call.
 type Stats struct {
 	// IdleConns is the number of connections sitting idle in the pool.
@@ -29,6 +83,39 @@ type Stats struct {
 	ActiveConns int32
 	// MaxConns is the configured upper bound.
 	MaxConns int32
+	// Saturation is ActiveConns / MaxConns, see Pool.Saturation.
+	Saturation float64
+
+	// DialCount is the cumulative number of successful dials.
+	DialCount int64
+	// DialErrorCount is the cumulative number of failed dials.
+	DialErrorCount int64
+	// EvictCount is the cumulative number of idle connections closed because
+	// they were idle for too long, reached their maximum lifetime, failed a
+	// liveness check or had to make room for other connections.
+	EvictCount int64
+	// WaitCount is the cumulative number of Acquire calls that had to wait
+	// for a connection to be released.
+	WaitCount int64
+	// RetireCount is the cumulative number of connections closed for any
+	// reason.
+	RetireCount int64
+	// AvgUsesBeforeRetire is how many times the retired connections were
+	// acquired on average. A low value means connections are recycled
+	// aggressively.
+	AvgUsesBeforeRetire float64
+
+	// HealthCheckPeriod is the current delay between health checks, which
+	// varies when AdaptiveHealthCheck is enabled.
+	HealthCheckPeriod time.Duration
+}
+
+// counters holds the cumulative statistics reported by Stats.
+type counters struct {
+	dials      int64
+	dialErrors int64
+	evictions  int64
+	waits      int64
 }
 
 // Config specifies the configuration for a Pool.
@@ -36,26 +123,421 @@ type Config struct {
 	// MaxConnLifetime is the duration since creation after which a connection will be automatically closed.
 	MaxConnLifetime time.Duration
 
+	// LifetimeStagger spreads out lifetime retirements so that connections
+	// created together are not all closed and redialed at once: at most one
+	// connection is retired per LifetimeStagger, and the others keep serving
+	// past their MaxConnLifetime until their turn.
+	LifetimeStagger time.Duration
+
 	// MaxConnIdleTime is the duration after which an idle connection will be automatically closed by the health check.
 	MaxConnIdleTime time.Duration
 
 	// MaxConn is the maximum size of the pool.
 	MaxConn int32
 
-	// MinConn is the minimum size of the pool.
+	// MinConn is the number of connections dialed when the pool is created.
 	MinConn int32
 
+	// MinIdleConn is the number of idle connections the pool keeps ready,
+	// topping up after releases and health checks as long as MaxConn allows.
+	MinIdleConn int32
+
 	// HealthCheckPeriod is the duration between checks of the health of idle connections.
 	HealthCheckPeriod time.Duration
 	Dialer            *websocket.Dialer
 	URL               string
+
+	// URLs, if set, spreads the connections of the default sub-pool (the
+	// one Acquire uses) across several equivalent backends. URL may then be
+	// left empty.
+	URLs []string
+
+	// URLWeights assigns each entry of URLs a positive weight; new
+	// connections are spread by weighted round-robin in proportion to it.
+	// Nil means equal weights.
+	URLWeights []int
+
+	// URLFunc, if set, resolves the URL of every new connection of the
+	// default sub-pool at dial time, e.g. from service discovery, so that
+	// the pool follows backend changes. It takes precedence over URL and
+	// URLs. ctx is the context of the Acquire that triggered the dial, or
+	// context.Background for background dials.
+	URLFunc func(ctx context.Context) (string, error)
+
+	// AdaptiveHealthCheck makes the health check back off while the pool is
+	// quiet: each check without an Acquire since the previous one doubles
+	// the period, up to MaxHealthCheckPeriod, and any Acquire resets it to
+	// HealthCheckPeriod. This reduces wakeups in idle services.
+	AdaptiveHealthCheck bool
+
+	// MaxHealthCheckPeriod caps the period under AdaptiveHealthCheck.
+	// Zero means eight times HealthCheckPeriod.
+	MaxHealthCheckPeriod time.Duration
+
+	// WriteTimeout bounds each send on a connection. Zero means no timeout.
+	WriteTimeout time.Duration
+
+	// ReadTimeout bounds each read on a connection. Zero means no timeout.
+	ReadTimeout time.Duration
+
+	// StrictOwnership makes send and read methods return ErrNotOwner when
+	// called from a goroutine other than the one that acquired the
+	// connection. It is a debugging aid for catching shared use of pooled
+	// connections and adds overhead to every operation.
+	StrictOwnership bool
+
+	// DefaultMessageType is the frame type used by SendMessage, either
+	// websocket.TextMessage or websocket.BinaryMessage. Zero means
+	// websocket.TextMessage.
+	DefaultMessageType int
+
+	// MaxConnBytes retires a connection once it has sent this many bytes of
+	// message payload: it is closed on release instead of being reused, and
+	// reported to OnEvict as EvictExpired. Zero means no limit.
+	MaxConnBytes int64
+
+	// ErrorClassifier decides whether a send or read error breaks the
+	// connection, should be retried on a redialed connection, or is simply
+	// returned. Nil means DefaultErrorClassifier.
+	ErrorClassifier func(error) ErrorKind
+
+	// MaxReconnectAttempts is how many times a connection is redialed after
+	// an ErrorRetriable error before the reconnect is abandoned with
+	// ErrReconnectAbandoned. Zero means one attempt.
+	MaxReconnectAttempts int
+
+	// MaxConcurrentOps limits the number of sends in flight across all
+	// connections of the pool, independently of MaxConn, for servers that
+	// multiplex many logical requests per connection. Sends beyond the limit
+	// block until others complete. Zero means no limit.
+	MaxConcurrentOps int
+
+	// OnConnError is called when a send or read error marks a connection
+	// broken, at most once per connection. It runs on its own goroutine, so it
+	// must not assume the connection is still usable.
+	OnConnError func(conn *WsConn, err error)
+
+	// DedupWindow is how long SendJSONDedup remembers a key. Zero means
+	// one minute.
+	DedupWindow time.Duration
+
+	// SaturationPolicy controls what Acquire does when all MaxConn
+	// connections are in use. The default, SaturationBlock, waits.
+	SaturationPolicy SaturationPolicy
+
+	// OnShed is called, outside the pool lock, each time Acquire sheds a
+	// request under SaturationShed.
+	OnShed func()
+
+	// SendInterceptor is called with every outgoing message before it is
+	// written and returns the payload to send in its place, e.g. for
+	// logging, redaction or encryption. An error aborts the send and is
+	// returned to the caller.
+	SendInterceptor func(messageType int, data []byte) ([]byte, error)
+
+	// ReceiveInterceptor is called with every incoming message before it is
+	// returned to the caller and returns the payload to use in its place.
+	// An error is returned to the caller instead of the message.
+	ReceiveInterceptor func(messageType int, data []byte) ([]byte, error)
+
+	// MessageValidator is called with every message read, after the
+	// ReceiveInterceptor. If it returns an error, the read returns that
+	// error instead of the message. The ErrorClassifier decides whether the
+	// error also marks the connection broken; the default does not.
+	MessageValidator func(data []byte) error
+
+	// CoalesceWindow makes SendMessage buffer messages for up to this long
+	// and send everything buffered as a single frame, with the messages
+	// separated by newlines, for servers that accept batched payloads. The
+	// buffer is also flushed by WsConn.Flush and on release. Errors of a
+	// timed flush are returned by the next SendMessage or Flush. Zero
+	// disables coalescing.
+	CoalesceWindow time.Duration
+
+	// OnNewConn is called with every freshly dialed connection before it is
+	// pooled, for application-level handshakes such as authentication. If
+	// it returns an error the connection is closed and the dial fails. It
+	// runs on the dialing goroutine right after the WebSocket handshake.
+	// Dials normally hold the pool's lock, while those Acquire starts under
+	// MaxPendingDials do not, so OnNewConn must not rely on either and must
+	// not call Pool methods.
+	//
+	// OnNewConn is not run again when a connection is redialed in place
+	// after a retriable error (see MaxReconnectAttempts): the redial
+	// happens inside the send or read that failed, which holds the
+	// connection, so the handshake could not use it. Only topics
+	// registered with WsConn.Subscribe are restored. Servers that need a
+	// per-socket handshake should classify such errors as ErrorBroken with
+	// ErrorClassifier, so that the connection is replaced by a fresh dial.
+	OnNewConn func(conn *WsConn) error
+
+	// OnNewConnRetries is how many more times OnNewConn is called on the
+	// same connection after it fails, so that a transient handshake error
+	// does not cost a redial. Retries stop early once the connection is
+	// broken.
+	OnNewConnRetries int
+
+	// OnMaxConnReached is called in its own goroutine when a new connection
+	// brings the pool up to MaxConn, for capacity alerts. It fires once per
+	// saturation: the pool has to drop below MaxConn before it fires again.
+	OnMaxConnReached func()
+
+	// ExpiryPolicy controls what happens to a connection that reaches
+	// MaxConnLifetime while acquired. The default, ExpireOnRelease, lets the
+	// holder finish and closes the connection on release.
+	ExpiryPolicy ExpiryPolicy
+
+	// OnPanic is called with the value of a panic recovered in one of the
+	// pool's background goroutines, typically raised by a user hook such as
+	// OnNewConn or an interceptor, after which the pool keeps running. If it
+	// is nil, the panic and its stack trace are logged with the log package.
+	OnPanic func(v any)
+
+	// ShouldPoolOnRelease, if set, is called when a healthy connection is
+	// released and decides whether it goes back to the pool (true) or is
+	// closed (false), for custom recycling policies such as a maximum
+	// UsageCount.
+	ShouldPoolOnRelease func(conn *WsConn) bool
+
+	// Limiter, if set, is shared with other pools to cap their combined
+	// number of open connections. Dials beyond the cap fail with
+	// ErrLimitReached.
+	Limiter *Limiter
+
+	// FollowRedirects is how many redirect responses to the upgrade request
+	// are followed by redialing their Location. The connection's URL is the
+	// one finally dialed. Zero treats a redirect as a failed handshake.
+	FollowRedirects int
+
+	// OnDrainMessage, if set, receives the messages still buffered on a
+	// connection that reached its MaxConnLifetime, which are otherwise lost
+	// when it is closed. A connection that expired while acquired is
+	// drained once it is released, unless ExpireImmediately closed it. The connection is read until no message
+	// arrives within DrainTimeout, then closed. The hook must not use conn
+	// other than to identify it.
+	OnDrainMessage func(conn *WsConn, data []byte)
+
+	// DrainTimeout is how long draining waits for each further message.
+	// Zero means 100ms.
+	DrainTimeout time.Duration
+
+	// WaitQueuePolicy is the order in which blocked Acquire calls of equal
+	// priority (see WithPriority) are served. The default, WaitFIFO, serves
+	// the longest waiting first.
+	WaitQueuePolicy WaitQueuePolicy
+
+	// AppPingMessage, if set, makes the health check verify every idle
+	// connection with an application-level ping, for servers that do not
+	// answer WebSocket pings, and evict those that fail. It is sent as a
+	// message of DefaultMessageType, and the connection is alive if a reply
+	// satisfying AppPongMatcher arrives within ReadTimeout, or one second if
+	// ReadTimeout is zero. Other messages read meanwhile are kept for the
+	// next read. Acquire still checks idle connections with a WebSocket
+	// ping, which costs no round trip.
+	AppPingMessage []byte
+
+	// AppPongMatcher reports whether a message is the reply to
+	// AppPingMessage. It is required when AppPingMessage is set.
+	AppPongMatcher func(data []byte) bool
+
+	// CompressionLevel is the flate compression level, from -2 (Huffman
+	// only) to 9 (best compression), used for messages written on
+	// connections that negotiated compression, see
+	// websocket.Dialer.EnableCompression. Zero keeps the websocket
+	// package's default.
+	CompressionLevel int
+
+	// OnEvict is called in its own goroutine whenever the pool closes a
+	// connection to take it out of service, with the reason why. It is not
+	// called for connections closed by Pool.Close or WsConn.Close.
+	OnEvict func(conn *WsConn, reason EvictReason)
+
+	// DefaultWriteContext, if set, is called for every send to obtain the
+	// context the send runs under, so that a service can apply a uniform
+	// write deadline or cancellation without passing contexts around. A
+	// send fails immediately if the context is already done, is bounded by
+	// its deadline (or WriteTimeout, whichever is sooner) and is
+	// interrupted if it is cancelled.
+	DefaultWriteContext func() context.Context
+
+	// MaxAcquireDuration enables leak detection: a connection acquired for
+	// longer than this without being released is reported to OnLeak. Zero
+	// disables it.
+	MaxAcquireDuration time.Duration
+
+	// OnLeak is called in its own goroutine with a connection held past
+	// MaxAcquireDuration and the stack trace of the goroutine that
+	// acquired it.
+	OnLeak func(conn *WsConn, stack []byte)
+
+	// MaxReaders and MaxWriters, if set, give AcquireReader and
+	// AcquireWriter their own sub-pools of connections to the same URL,
+	// each capped independently of MaxConn and of each other, so that
+	// readers blocked on subscriptions cannot starve writers of
+	// connections. A sub-pool left at zero makes its acquire method fall
+	// back to Acquire.
+	MaxReaders int32
+	MaxWriters int32
+
+	// MaxPendingDials, if set, lets Acquire dial without holding the pool's
+	// lock, with at most this many dials in flight; acquirers beyond the
+	// cap wait for one of them to finish and then retry, which often finds
+	// the new connection idle. A slot being dialed counts towards MaxConn.
+	// Zero keeps dials serialized, one at a time.
+	MaxPendingDials int
+
+	// TransferState, if set, carries application state over from a
+	// connection the pool retired to the connection dialed to replace it.
+	// Connections that expired, were rotated by DrainURL or broke are
+	// remembered, up to MaxConn of them, and the next connection dialed
+	// for the same URL is passed to TransferState along with the oldest of
+	// them, after OnNewConn succeeded, e.g. to copy values set with
+	// WsConn.SetValue. An error discards the new connection like an
+	// OnNewConn failure. Connections redialed in place after a retriable
+	// error keep their state and are not passed to TransferState.
+	TransferState func(old, new *WsConn) error
+
+	// WriteBufferPool, if set, is shared by the pool's connections for
+	// their write buffers: a connection only holds a buffer while it writes
+	// a message, which saves WriteBufferSize bytes per idle connection in
+	// large pools. It replaces the Dialer's WriteBufferPool; the Dialer
+	// itself is not modified. AcquireForSize dials without it, since a
+	// pool must only hold buffers of one size.
+	WriteBufferPool websocket.BufferPool
+
+	// SharedWriteBuffers makes New create a WriteBufferPool backed by a
+	// sync.Pool when WriteBufferPool is nil.
+	SharedWriteBuffers bool
+
+	// ReclaimLeaks makes the pool take back connections held past
+	// MaxAcquireDuration: the lease is revoked, so the holder's Release is
+	// ignored, and the connection is closed and reported to OnEvict as
+	// EvictLeaked.
+	ReclaimLeaks bool
+}
+
+// SaturationPolicy is what Acquire does when the pool is at MaxConn.
+type SaturationPolicy int
+
+const (
+	// SaturationBlock waits for a connection to be released or for the
+	// context to end.
+	SaturationBlock SaturationPolicy = iota
+	// SaturationError fails immediately with ErrPoolExhausted.
+	SaturationError
+	// SaturationShed calls Config.OnShed and fails immediately with ErrShed,
+	// so that callers can fall back to another path.
+	SaturationShed
+)
+
+// EvictReason is why the pool took a connection out of service, see
+// Config.OnEvict.
+type EvictReason int
+
+const (
+	// EvictIdle: the connection was idle for longer than MaxConnIdleTime.
+	EvictIdle EvictReason = iota + 1
+	// EvictExpired: the connection reached its MaxConnLifetime or
+	// MaxConnBytes.
+	EvictExpired
+	// EvictBroken: a send, read or liveness check failed.
+	EvictBroken
+	// EvictRotated: the connection's URL was drained by DrainURL.
+	EvictRotated
+	// EvictInvalidated: the connection was passed to Invalidate.
+	EvictInvalidated
+	// EvictRecycled: ShouldPoolOnRelease declined to pool the connection.
+	EvictRecycled
+	// EvictLeaked: the connection was reclaimed after being held past
+	// MaxAcquireDuration.
+	EvictLeaked
+	// EvictDisplaced: the idle connection was closed to make room in a full
+	// pool for a connection to another URL or with other dial settings.
+	EvictDisplaced
+	// EvictSurplus: the pool held more idle connections than MaxConn.
+	EvictSurplus
+)
+
+func (r EvictReason) String() string {
+	switch r {
+	case EvictIdle:
+		return "idle"
+	case EvictExpired:
+		return "expired"
+	case EvictBroken:
+		return "broken"
+	case EvictRotated:
+		return "rotated"
+	case EvictInvalidated:
+		return "invalidated"
+	case EvictRecycled:
+		return "recycled"
+	case EvictLeaked:
+		return "leaked"
+	case EvictDisplaced:
+		return "displaced"
+	case EvictSurplus:
+		return "surplus"
+	}
+	return "EvictReason(" + strconv.Itoa(int(r)) + ")"
 }
 
+// WaitQueuePolicy is the order in which Acquire calls blocked on a saturated
+// pool are served.
+type WaitQueuePolicy int
+
+const (
+	// WaitFIFO serves waiters in arrival order.
+	WaitFIFO WaitQueuePolicy = iota
+	// WaitLIFO serves the most recent waiter first, favouring requests that
+	// are likely still relevant under bursty load; old waiters are left to
+	// time out.
+	WaitLIFO
+)
+
+// ExpiryPolicy is how the pool retires an acquired connection that reached
+// its MaxConnLifetime. Idle connections are always closed at expiry.
+type ExpiryPolicy int
+
+const (
+	// ExpireOnRelease closes the connection when it is released instead of
+	// returning it to the pool.
+	ExpireOnRelease ExpiryPolicy = iota
+	// ExpireImmediately closes the connection at once, failing any send or
+	// read in progress. It is still released as usual.
+	ExpireImmediately
+)
+
+var (
+	// ErrPoolExhausted is returned by Acquire under SaturationError when all
+	// connections are in use.
+	ErrPoolExhausted = errors.New("pool exhausted")
+	// ErrShed is returned by Acquire under SaturationShed when all
+	// connections are in use.
+	ErrShed = errors.New("acquire shed: pool saturated")
+)
+
 // New creates a new Pool with the specified configuration.
 func New(config Config) (*Pool, error) {
-	if config.Dialer == nil || config.URL == "" {
+	return create(config, nil)
+}
+
+// create implements New for a pool, or for a role sub-pool of parent.
+func create(config Config, parent *Pool) (*Pool, error) {
+	if config.Dialer == nil || (config.URL == "" && len(config.URLs) == 0 && config.URLFunc == nil) {
 		return nil, errors.New("dialer and URL must be provided")
 	}
+	if config.URLWeights != nil {
+		if len(config.URLWeights) != len(config.URLs) {
+			return nil, errors.New("URLWeights must have one weight per URL")
+		}
+		for _, w := range config.URLWeights {
+			if w <= 0 {
+				return nil, errors.New("URLWeights must be greater than zero")
+			}
+		}
+	}
+	config.URLs = slices.Clone(config.URLs)
 	if config.HealthCheckPeriod <= 0 {
 		return nil, errors.New("HealthCheckPeriod must be greater than zero")
 	}
@@ -65,24 +547,112 @@ func New(config Config) (*Pool, error) {
 	if config.MinConn < 0 || config.MinConn > config.MaxConn {
 		return nil, errors.New("MinConn must be between 0 and MaxConn")
 	}
+	if config.MinIdleConn < 0 || config.MinIdleConn > config.MaxConn {
+		return nil, errors.New("MinIdleConn must be between 0 and MaxConn")
+	}
+	if config.AdaptiveHealthCheck && config.MaxHealthCheckPeriod == 0 {
+		config.MaxHealthCheckPeriod = 8 * config.HealthCheckPeriod
+	}
+	if config.MaxHealthCheckPeriod != 0 && config.MaxHealthCheckPeriod < config.HealthCheckPeriod {
+		return nil, errors.New("MaxHealthCheckPeriod must not be less than HealthCheckPeriod")
+	}
+	if config.MaxConcurrentOps < 0 {
+		return nil, errors.New("MaxConcurrentOps must not be negative")
+	}
+	if config.OnNewConnRetries < 0 {
+		return nil, errors.New("OnNewConnRetries must not be negative")
+	}
+	if config.CompressionLevel < flate.HuffmanOnly || config.CompressionLevel > flate.BestCompression {
+		return nil, errors.New("CompressionLevel must be between -2 and 9")
+	}
+	if config.AppPingMessage != nil && config.AppPongMatcher == nil {
+		return nil, errors.New("AppPongMatcher must be set with AppPingMessage")
+	}
+	if config.WaitQueuePolicy != WaitFIFO && config.WaitQueuePolicy != WaitLIFO {
+		return nil, errors.New("invalid WaitQueuePolicy")
+	}
+	if config.MaxReaders < 0 || config.MaxWriters < 0 {
+		return nil, errors.New("MaxReaders and MaxWriters must not be negative")
+	}
+	if config.MaxPendingDials < 0 {
+		return nil, errors.New("MaxPendingDials must not be negative")
+	}
+	if config.MaxAcquireDuration < 0 {
+		return nil, errors.New("MaxAcquireDuration must not be negative")
+	}
+	if config.DrainTimeout < 0 {
+		return nil, errors.New("DrainTimeout must not be negative")
+	}
+	if config.FollowRedirects < 0 {
+		return nil, errors.New("FollowRedirects must not be negative")
+	}
+	if config.MaxReconnectAttempts < 0 {
+		return nil, errors.New("MaxReconnectAttempts must not be negative")
+	}
+	if config.LifetimeStagger < 0 {
+		return nil, errors.New("LifetimeStagger must not be negative")
+	}
+	if config.ExpiryPolicy != ExpireOnRelease && config.ExpiryPolicy != ExpireImmediately {
+		return nil, errors.New("invalid ExpiryPolicy")
+	}
+	if config.WriteBufferPool == nil && config.SharedWriteBuffers {
+		config.WriteBufferPool = &sync.Pool{}
+	}
+	if config.WriteBufferPool != nil {
+		dialer := *config.Dialer
+		dialer.WriteBufferPool = config.WriteBufferPool
+		config.Dialer = &dialer
+	}
+	switch config.DefaultMessageType {
+	case 0:
+		config.DefaultMessageType = websocket.TextMessage
+	case websocket.TextMessage, websocket.BinaryMessage:
+	default:
+		return nil, errors.New("DefaultMessageType must be TextMessage or BinaryMessage")
+	}
 
 	p := &Pool{
-		config:    &config,
-		conns:     make([]*WsConn, 0, config.MinConn),
-		closeChan: make(chan struct{}),
+		config:       &config,
+		idle:         &lifoStore{conns: make([]*WsConn, 0, config.MinConn)},
+		closeChan:    make(chan struct{}),
+		resumeChan:   make(chan struct{}, 1),
+		healthPeriod: config.HealthCheckPeriod,
+		wrr:          make([]int, len(config.URLs)),
+		anyMessages:  make(chan anyMessage),
+		errs:         make(chan error, errorsBuffer),
+		parent:       parent,
+	}
+	if config.MaxConcurrentOps > 0 {
+		p.ops = make(chan struct{}, config.MaxConcurrentOps)
 	}
 
 	// Initialize minimum connections; close any already-created ones on failure.
+	// The lock guards against expiry timers of the first connections.
+	p.lock.Lock()
 	for i := int32(0); i < config.MinConn; i++ {
-		conn, err := p.newConnection()
+		conn, err := p.newConnection(context.Background(), "")
 		if err != nil {
-			for _, c := range p.conns {
+			for _, c := range p.idleConns() {
 				c.disconnect()
 				p.activeConnections--
 			}
+			p.lock.Unlock()
 			return nil, err
 		}
-		p.conns = append(p.conns, conn)
+		p.idle.Put(conn)
+	}
+	p.lock.Unlock()
+
+	var err error
+	if p.readers, err = p.newRolePool(config, config.MaxReaders); err == nil {
+		p.writers, err = p.newRolePool(config, config.MaxWriters)
+	}
+	if err != nil {
+		p.Close()
+		return nil, err
+	}
+	for _, role := range p.roles() {
+		go p.forwardErrors(role)
 	}
 
 	go p.startHealthCheck()
@@ -90,215 +660,1627 @@ func New(config Config) (*Pool, error) {
 	return p, nil
 }
 
-// newConnection dials a new WebSocket connection and wraps it in a WsConn.
-func (p *Pool) newConnection() (*WsConn, error) {
-	conn, _, err := p.config.Dialer.Dial(p.config.URL, nil)
+// newConnection dials a new WebSocket connection for target and wraps it in a WsConn.
+// An empty target dials the configured URL.
+func (p *Pool) newConnection(ctx context.Context, target string) (*WsConn, error) {
+	return p.newConnectionWith(ctx, target, p.config.Dialer)
+}
+
+// newConnectionWith is newConnection with a dialer other than the configured
+// one, which the connection also uses to redial. The dial runs under p.lock;
+// see dialUnlocked for the variant that releases it.
+func (p *Pool) newConnectionWith(ctx context.Context, target string, dialer *websocket.Dialer) (*WsConn, error) {
+	d, err := p.prepareDial(ctx, target, dialer)
+	if err != nil {
+		return nil, err
+	}
+	w, dialed, err := d.run()
+	return p.finishDial(d, w, dialed, err)
+}
+
+// dialUnlocked dials a new connection for target with p.lock released
+// during the dial, holding a MaxConn slot and a MaxPendingDials slot for it.
+// Must be called with p.lock held; it returns with p.lock released.
+func (p *Pool) dialUnlocked(ctx context.Context, target string) (*WsConn, error) {
+	d, err := p.prepareDial(ctx, target, p.config.Dialer)
 	if err != nil {
+		p.lock.Unlock()
 		return nil, err
 	}
+	p.pendingDials++
 	p.activeConnections++
+	p.lock.Unlock()
 
-	return &WsConn{
-		p:          p,
-		c:          conn,
-		createdAt:  time.Now(),
-		lastUsedAt: time.Now(),
-	}, nil
-}
+	w, dialed, err := d.run()
 
-// Acquire returns a connection from the pool, blocking until one is available
-// or ctx is cancelled. Idle connections are verified with a ping before being
-// returned; dead ones are discarded and the loop retries.
-func (p *Pool) Acquire(ctx context.Context) (*WsConn, error) {
-	for {
-		p.lock.Lock()
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.pendingDials--
+	p.activeConnections--
+	if p.dialDone != nil {
+		close(p.dialDone)
+		p.dialDone = nil
+	}
+	if err == nil && p.closed {
+		w.disconnect()
+		return nil, errors.New("pool is closed")
+	}
+	conn, err := p.finishDial(d, w, dialed, err)
+	if err != nil {
+		// The reserved slot may have turned a waiter away.
+		p.wakeWaiter()
+	}
+	return conn, err
+}
 
-		if p.closed {
-			p.lock.Unlock()
-			return nil, errors.New("pool is closed")
-		}
+// pendingDial is a dial prepared under p.lock that can run without it.
+type pendingDial struct {
+	p      *Pool
+	id     string
+	url    string
+	target string
+	dialer *websocket.Dialer
 
-		// Reuse an idle connection.
-		if len(p.conns) > 0 {
-			conn := p.conns[len(p.conns)-1]
-			p.conns = p.conns[:len(p.conns)-1]
-			p.lock.Unlock()
+	// predecessor is the retired connection whose state is transferred to
+	// the new one, or nil.
+	predecessor *WsConn
+}
 
-			if !conn.ping() {
-				// Connection is dead; discard and retry.
-				p.lock.Lock()
-				p.activeConnections--
-				p.lock.Unlock()
-				continue
-			}
-			return conn, nil
+// prepareDial picks the URL and ID of a new connection for target.
+// Must be called with p.lock held.
+func (p *Pool) prepareDial(ctx context.Context, target string, dialer *websocket.Dialer) (*pendingDial, error) {
+	url := target
+	if url == "" {
+		var err error
+		if url, err = p.nextURL(ctx); err != nil {
+			p.counters.dialErrors++
+			return nil, err
 		}
+	}
+	// Dials only start below MaxConn, so the pool has left saturation.
+	p.saturated = false
+	// IDs come from the root pool so that they are unique across the reader
+	// and writer sub-pools.
+	id := p.root().lastID.Add(1)
+	return &pendingDial{
+		p:           p,
+		id:          strconv.FormatUint(id, 10),
+		url:         url,
+		target:      target,
+		dialer:      dialer,
+		predecessor: p.takePredecessor(target),
+	}, nil
+}
 
-		// Create a new connection if capacity allows.
-		if p.activeConnections < p.config.MaxConn {
-			conn, err := p.newConnection()
-			p.lock.Unlock()
-			if err != nil {
-				return nil, err
-			}
-			return conn, nil
+// run dials the connection and runs OnNewConn and TransferState on it. It
+// reports whether a socket was dialed, even if a hook then failed. It does
+// not touch state guarded by p.lock, which its callers may or may not hold,
+// so the hooks run at the same point of every dial.
+func (d *pendingDial) run() (w *WsConn, dialed bool, err error) {
+	p := d.p
+	if p.config.Limiter != nil && !p.config.Limiter.acquire() {
+		return nil, false, ErrLimitReached
+	}
+	conn, resp, url, err := dial(d.dialer, d.url, p.config.FollowRedirects)
+	if err != nil {
+		if p.config.Limiter != nil {
+			p.config.Limiter.release()
 		}
+		return nil, false, err
+	}
 
-		// Pool is at capacity — register as a waiter and block.
-		ch := make(chan *WsConn, 1)
-		p.waiters = append(p.waiters, ch)
-		p.lock.Unlock()
+	w = &WsConn{pooledConn: &pooledConn{
+		id:              d.id,
+		p:               p,
+		c:               conn,
+		dialer:          d.dialer,
+		limiter:         p.config.Limiter,
+		writeBufferSize: writeBufferSize(d.dialer),
+		url:             url,
+		target:          d.target,
+		createdAt:       time.Now(),
+		lastUsedAt:      time.Now(),
+	}}
+	w.watchControlFrames(conn)
+	w.setCompressionLevel(conn)
+	w.sock.Store(conn)
+	w.setHandshakeHeaders(resp)
+	if err := p.handshake(w); err != nil {
+		w.disconnect()
+		return nil, true, err
+	}
+	if d.predecessor != nil {
+		if err := p.config.TransferState(d.predecessor, w); err != nil {
+			w.disconnect()
+			return nil, true, err
+		}
+	}
+	return w, true, nil
+}
 
-		select {
-		case conn := <-ch:
-			if !conn.ping() {
-				p.lock.Lock()
-				p.activeConnections--
-				p.lock.Unlock()
-				continue
-			}
-			return conn, nil
-		case <-ctx.Done():
-			p.removeWaiter(ch)
-			return nil, ctx.Err()
+// finishDial records the outcome of d and, on success, counts w as active
+// and arms its expiry. On failure d's predecessor waits for the next dial.
+// Must be called with p.lock held.
+func (p *Pool) finishDial(d *pendingDial, w *WsConn, dialed bool, err error) (*WsConn, error) {
+	if dialed {
+		p.counters.dials++
+	}
+	if err != nil {
+		if d.predecessor != nil {
+			p.predecessors = slices.Insert(p.predecessors, 0, d.predecessor)
+		}
+		if !errors.Is(err, ErrLimitReached) {
+			p.counters.dialErrors++
+		}
+		return nil, err
+	}
+	p.activeConnections++
+	// Under MaxPendingDials a reserved slot is given back and taken again
+	// here, so several dials of a burst can see MaxConn; only the first one
+	// reports it.
+	if p.activeConnections == p.config.MaxConn && !p.saturated {
+		p.saturated = true
+		if p.config.OnMaxConnReached != nil {
+			go func() {
+				defer p.recoverPanic()
+				p.config.OnMaxConnReached()
+			}()
 		}
 	}
+	// Evict the connection at its exact expiry rather than on the next
+	// health-check tick.
+	if p.config.MaxConnLifetime > 0 {
+		w.expiry = time.AfterFunc(p.config.MaxConnLifetime, func() {
+			defer p.recoverPanic()
+			p.expire(w)
+		})
+	}
+	return w, nil
 }
 
-// removeWaiter removes ch from the waiters list and returns any connection
-// that arrived just before the context was cancelled back to the pool.
-func (p *Pool) removeWaiter(ch chan *WsConn) {
-	p.lock.Lock()
-	for i, w := range p.waiters {
-		if w == ch {
-			p.waiters = append(p.waiters[:i], p.waiters[i+1:]...)
-			break
+// nextURL picks the URL for a new connection of the default sub-pool: the
+// one resolved by URLFunc, else one of URLs by smooth weighted round-robin,
+// else URL.
+// Must be called with p.lock held.
+func (p *Pool) nextURL(ctx context.Context) (string, error) {
+	if p.config.URLFunc != nil {
+		return p.config.URLFunc(ctx)
+	}
+	if len(p.config.URLs) == 0 {
+		return p.config.URL, nil
+	}
+	best, total := 0, 0
+	for i := range p.config.URLs {
+		weight := 1
+		if p.config.URLWeights != nil {
+			weight = p.config.URLWeights[i]
+		}
+		p.wrr[i] += weight
+		total += weight
+		if p.wrr[i] > p.wrr[best] {
+			best = i
 		}
 	}
-	p.lock.Unlock()
+	p.wrr[best] -= total
+	return p.config.URLs[best], nil
+}
 
-	// Drain: a connection may have been sent between ctx cancellation and
-	// waiter removal. If so, return it to the pool.
-	select {
-	case conn := <-ch:
-		p.release(conn)
-	default:
+// handshake runs OnNewConn on a new connection, retrying it up to
+// OnNewConnRetries times while the connection is usable.
+func (p *Pool) handshake(w *WsConn) error {
+	if p.config.OnNewConn == nil {
+		return nil
+	}
+	err := p.config.OnNewConn(w)
+	for i := 0; err != nil && i < p.config.OnNewConnRetries && !w.broken.Load(); i++ {
+		err = p.config.OnNewConn(w)
 	}
+	return err
 }
 
-// release returns a connection to the pool.
-func (p *Pool) release(conn *WsConn) {
+// expire closes conn once its MaxConnLifetime has elapsed if it is idle.
+// Acquired connections are retired according to the ExpiryPolicy.
+func (p *Pool) expire(conn *WsConn) {
 	p.lock.Lock()
 	defer p.lock.Unlock()
 
 	if p.closed {
-		conn.disconnect()
-		p.activeConnections--
 		return
 	}
-
-	// Hand the connection directly to a waiter if one is waiting.
-	// maintainPoolSize is not called here: the connection remains active
-	// (owned by the waiter), so pool size is unchanged.
-	if len(p.waiters) > 0 {
-		ch := p.waiters[0]
-		p.waiters = p.waiters[1:]
-		ch <- conn
+	// Under LifetimeStagger, reserve the next free retirement slot and come
+	// back then.
+	if d := p.config.LifetimeStagger; d > 0 && conn.retireAt.IsZero() {
+		now := time.Now()
+		slot := p.nextRetire
+		if slot.Before(now) {
+			slot = now
+		}
+		p.nextRetire = slot.Add(d)
+		conn.retireAt = slot
+		if wait := slot.Sub(now); wait > 0 {
+			conn.expiry.Reset(wait)
+			return
+		}
+	}
+	if p.idle.Remove(conn) {
+		p.counters.evictions++
+		p.notifyEvict(conn, EvictExpired)
+		if p.closeExpired(conn) {
+			p.maintainPoolSize()
+		}
 		return
 	}
-
-	if int32(len(p.conns)) < p.config.MaxConn {
-		p.conns = append(p.conns, conn)
-	} else {
-		conn.disconnect()
-		p.activeConnections--
+	// Not idle, so acquired unless it was closed already.
+	sock := conn.sock.Load()
+	if sock == nil || conn.broken.Swap(true) {
+		return
+	}
+	conn.evictReason.CompareAndSwap(0, int32(EvictExpired))
+	p.counters.evictions++
+	if p.config.ExpiryPolicy == ExpireImmediately {
+		// A read may hold conn.mu indefinitely, so close the socket directly
+		// as CancelRead does; release cleans up the rest.
+		sock.Close()
 	}
+}
 
-	p.maintainPoolSize()
+// closeExpired closes conn, an expired connection that is no longer idle,
+// after draining its buffered messages to OnDrainMessage if that is set. A
+// drained connection keeps its slot until drainAndClose is done, so
+// closeExpired reports whether the slot was freed right away.
+// Must be called with p.lock held.
+func (p *Pool) closeExpired(conn *WsConn) bool {
+	if p.config.OnDrainMessage != nil {
+		go p.drainAndClose(conn)
+		return false
+	}
+	conn.disconnect()
+	p.activeConnections--
+	return true
 }
 
-// Close closes all connections in the pool.
-func (p *Pool) Close() {
-	p.closeOnce.Do(func() {
-		close(p.closeChan)
+// drainAndClose delivers the messages still buffered on an expired
+// connection to OnDrainMessage and then closes it.
+func (p *Pool) drainAndClose(conn *WsConn) {
+	defer func() {
+		conn.disconnect()
 		p.lock.Lock()
 		defer p.lock.Unlock()
-
-		p.closed = true
-		for _, conn := range p.conns {
-			conn.disconnect()
-			p.activeConnections--
+		p.activeConnections--
+		if !p.closed && !p.wakeWaiter() {
+			p.maintainPoolSize()
 		}
-		p.conns = nil
-	})
-}
+	}()
+	defer p.recoverPanic()
 
-// Stats returns a snapshot of the current pool state.
-func (p *Pool) Stats() Stats {
-	p.lock.Lock()
-	defer p.lock.Unlock()
-	return Stats{
-		IdleConns:   int32(len(p.conns)),
-		ActiveConns: p.activeConnections,
-		MaxConns:    p.config.MaxConn,
+	timeout := p.config.DrainTimeout
+	if timeout <= 0 {
+		timeout = defaultDrainTimeout
 	}
-}
-
-// maintainPoolSize ensures the idle pool stays between MinConn and MaxConn.
-func (p *Pool) maintainPoolSize() {
-	for int32(len(p.conns)) < p.config.MinConn {
-		conn, err := p.newConnection()
+	// Mark it broken up front so that the read ending the drain is not
+	// reported to OnConnError.
+	conn.broken.Store(true)
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	for conn.c != nil {
+		_, data, err := conn.readMessage(timeout)
 		if err != nil {
-			break
+			return
 		}
-		p.conns = append(p.conns, conn)
+		p.config.OnDrainMessage(conn, data)
 	}
+}
 
-	for int32(len(p.conns)) > p.config.MaxConn {
-		conn := p.conns[len(p.conns)-1]
-		p.conns = p.conns[:len(p.conns)-1]
-		conn.disconnect()
-		p.activeConnections--
-	}
+// waiter is an Acquire call blocked on a connection for target.
+// A nil value sent on ch tells the waiter that capacity was freed and it
+// should retry.
+type waiter struct {
+	target   string
+	ch       chan *WsConn
+	priority int
 }
 
-// isIdleOrExpired reports whether a connection should be evicted.
-func (p *Pool) isIdleOrExpired(conn *WsConn, now time.Time) bool {
-	if p.config.MaxConnLifetime > 0 && now.Sub(conn.createdAt) > p.config.MaxConnLifetime {
-		return true
-	}
-	if p.config.MaxConnIdleTime > 0 && now.Sub(conn.lastUsedAt) > p.config.MaxConnIdleTime {
-		return true
+// waiterPos returns where a waiter with priority joins the queue: behind
+// waiters of higher priority and, by WaitQueuePolicy, behind (FIFO) or ahead
+// of (LIFO) those of equal priority.
+// Must be called with p.lock held.
+func (p *Pool) waiterPos(priority int) int {
+	for i, w := range p.waiters {
+		if w.priority < priority || (w.priority == priority && p.config.WaitQueuePolicy == WaitLIFO) {
+			return i
+		}
 	}
-	return false
+	return len(p.waiters)
 }
 
-func (p *Pool) startHealthCheck() {
-	ticker := time.NewTicker(p.config.HealthCheckPeriod)
-	defer ticker.Stop()
+// priorityKey is the context key for WithPriority.
+type priorityKey struct{}
 
-	for {
-		select {
-		case <-ticker.C:
-			p.lock.Lock()
+// WithPriority returns a copy of ctx carrying an acquire priority. When the
+// pool is saturated, Acquire calls with a higher priority are served before
+// waiters with a lower one, whatever their arrival order. The default
+// priority is zero; negative priorities rank below it.
+func WithPriority(ctx context.Context, priority int) context.Context {
+	return context.WithValue(ctx, priorityKey{}, priority)
+}
 
-			var healthy []*WsConn
-			now := time.Now()
-			for _, conn := range p.conns {
-				if p.isIdleOrExpired(conn, now) {
-					conn.disconnect()
-					p.activeConnections--
-					continue
+// priorityFrom returns the priority set on ctx by WithPriority, or zero.
+func priorityFrom(ctx context.Context) int {
+	priority, _ := ctx.Value(priorityKey{}).(int)
+	return priority
+}
+
+// Acquire returns a connection from the pool, blocking until one is available
+// or ctx is cancelled. Idle connections are verified with a ping before being
+// returned; dead ones are discarded and the loop retries.
+func (p *Pool) Acquire(ctx context.Context) (*WsConn, error) {
+	return p.acquire(ctx, "", p.config.SaturationPolicy)
+}
+
+// AcquireURL is like Acquire but returns a connection to url instead of the
+// configured URL. Connections are kept in separate sub-pools per URL that
+// share the MaxConn limit.
+func (p *Pool) AcquireURL(ctx context.Context, url string) (*WsConn, error) {
+	return p.acquire(ctx, url, p.config.SaturationPolicy)
+}
+
+// AcquireByKey is like AcquireURL but picks the URL by consistently hashing
+// key over URLs, so that a given key always reaches the same backend of a
+// sharded service. Adding or removing a URL only remaps the keys of that
+// URL. URLWeights do not apply. Without URLs it acquires a connection to URL.
+func (p *Pool) AcquireByKey(ctx context.Context, key string) (*WsConn, error) {
+	p.lock.Lock()
+	url := p.keyURL(key)
+	p.lock.Unlock()
+	if url == "" {
+		return nil, errors.New("AcquireByKey requires URL or URLs")
+	}
+	return p.AcquireURL(ctx, url)
+}
+
+// mix64 is the splitmix64 finalizer. FNV-1a barely changes the high bits
+// of the hash for the last bytes written, so without it most keys would
+// score highest on the same URL.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// keyURL returns the URL that key hashes to, using rendezvous hashing: each
+// URL scores the key and the highest score wins.
+// Must be called with p.lock held.
+func (p *Pool) keyURL(key string) string {
+	if len(p.config.URLs) == 0 {
+		return p.config.URL
+	}
+	var best string
+	var bestScore uint64
+	for _, url := range p.config.URLs {
+		h := fnv.New64a()
+		h.Write([]byte(url))
+		h.Write([]byte{0})
+		h.Write([]byte(key))
+		if score := mix64(h.Sum64()); best == "" || score > bestScore {
+			best, bestScore = url, score
+		}
+	}
+	return best
+}
+
+// TryAcquire is a non-blocking Acquire for callers with a fallback path. It
+// returns an idle connection or dials a new one if the pool is below
+// MaxConn, and reports false without waiting if the pool is saturated or the
+// dial fails. Config.SaturationPolicy does not apply.
+func (p *Pool) TryAcquire() (*WsConn, bool) {
+	conn, err := p.acquire(context.Background(), "", SaturationError)
+	return conn, err == nil
+}
+
+// AcquireWithBudget is like Acquire but also returns how much time remains
+// until ctx's deadline once the connection has been acquired, so that chained
+// operations can size their own timeouts. If ctx has no deadline the budget
+// is the maximum time.Duration.
+func (p *Pool) AcquireWithBudget(ctx context.Context) (*WsConn, time.Duration, error) {
+	conn, err := p.Acquire(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return conn, math.MaxInt64, nil
+	}
+	return conn, time.Until(deadline), nil
+}
+
+// SendAny sends the same message on every idle connection to the configured
+// URL concurrently and returns as soon as one send succeeds, for redundancy
+// when any single delivery is enough. If no connection is idle, one is
+// acquired. Sends that have not started when the first one succeeds are
+// skipped and their connections pinged instead; connections whose send or
+// ping fails are marked broken and evicted. If all sends fail, their errors
+// are returned joined.
+func (p *Pool) SendAny(ctx context.Context, messageType int, data []byte) error {
+	p.lock.Lock()
+	var conns []*WsConn
+	for conn := p.takeIdle(""); conn != nil; conn = p.takeIdle("") {
+		conns = append(conns, conn)
+	}
+	p.lock.Unlock()
+	for i, conn := range conns {
+		conns[i] = p.checkout(conn)
+	}
+
+	if len(conns) == 0 {
+		conn, err := p.Acquire(ctx)
+		if err != nil {
+			return err
+		}
+		conns = append(conns, conn)
+	}
+
+	sendCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan error, len(conns))
+	for _, conn := range conns {
+		go func() {
+			defer conn.Release()
+			defer func() {
+				if v := recover(); v != nil {
+					p.reportPanic(v)
+					results <- fmt.Errorf("send panicked: %v", v)
 				}
-				healthy = append(healthy, conn)
+			}()
+			if err := sendCtx.Err(); err != nil {
+				// The connection was not used, so make sure it is still
+				// alive before it goes back to the pool.
+				if !conn.ping() {
+					conn.broken.Store(true)
+				}
+				results <- err
+				return
+			}
+			err := conn.sendFrame(messageType, data)
+			if err != nil {
+				conn.markBroken(err)
 			}
-			p.conns = healthy
+			results <- err
+		}()
+	}
 
-			p.maintainPoolSize()
+	var errs []error
+	for range conns {
+		select {
+		case err := <-results:
+			if err == nil {
+				return nil
+			}
+			errs = append(errs, err)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// anyMessage is a message read by a ReadAny background reader.
+type anyMessage struct {
+	data []byte
+	conn *WsConn
+}
+
+// ReadAny returns the next message received on any connection of the
+// configured URL, together with the connection it arrived on, for pools
+// dedicated to consuming server pushes. Each call hands every idle
+// connection to a background reader that keeps reading from it until a read
+// fails or the pool is closed; if no reader is running and none is idle, a
+// connection is acquired for one. Messages are delivered in the order the
+// readers receive them and are never dropped. The returned connection is
+// owned by its reader: use it for identification only.
+func (p *Pool) ReadAny(ctx context.Context) ([]byte, *WsConn, error) {
+	p.lock.Lock()
+	var conns []*WsConn
+	for conn := p.takeIdle(""); conn != nil; conn = p.takeIdle("") {
+		conns = append(conns, conn)
+	}
+	idle := p.anyReaders == 0 && len(conns) == 0
+	p.anyReaders += len(conns)
+	p.lock.Unlock()
+
+	if idle {
+		conn, err := p.acquireConn(ctx, "", p.config.SaturationPolicy)
+		if err != nil {
+			return nil, nil, err
+		}
+		p.lock.Lock()
+		p.anyReaders++
+		p.lock.Unlock()
+		conns = append(conns, conn)
+	}
+	for _, conn := range conns {
+		go p.readAny(p.checkout(conn))
+	}
+
+	select {
+	case msg := <-p.anyMessages:
+		return msg.data, msg.conn, nil
+	case <-p.closeChan:
+		return nil, nil, errors.New("pool is closed")
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	}
+}
+
+// readAny is the ReadAny background reader for conn. It releases conn once
+// a read fails, which closes it, or the pool is closed.
+func (p *Pool) readAny(conn *WsConn) {
+	done := make(chan struct{})
+	defer func() {
+		close(done)
+		p.lock.Lock()
+		p.anyReaders--
+		p.lock.Unlock()
+		conn.Release()
+	}()
+	defer p.recoverPanic()
+	go func() {
+		select {
+		case <-p.closeChan:
+			conn.CancelRead()
+		case <-done:
+		}
+	}()
+
+	for {
+		data, err := conn.ReadMessage()
+		if err != nil {
+			conn.markBroken(err)
+			return
+		}
+		select {
+		case p.anyMessages <- anyMessage{data: data, conn: conn}:
+		case <-p.closeChan:
+			return
+		}
+	}
+}
+
+// AcquireForSize is like Acquire but prefers a connection whose write buffer
+// holds at least expectedBytes, so that large messages are written without
+// being split across buffer flushes. If no such connection is idle and the
+// pool has room, or an idle connection with a smaller buffer can make room,
+// one is dialed with a larger write buffer. Otherwise it falls back to
+// Acquire: the size is a hint, not a guarantee.
+func (p *Pool) AcquireForSize(ctx context.Context, expectedBytes int) (*WsConn, error) {
+	// Never dial a smaller buffer than the configured one: the connection
+	// goes back to the pool and is reused by plain Acquire calls.
+	dialer := *p.config.Dialer
+	dialer.WriteBufferSize = max(expectedBytes, writeBufferSize(p.config.Dialer))
+	dialer.WriteBufferPool = nil
+	conn, err := p.takeOrDial(ctx, func(conn *WsConn) bool {
+		return conn.target == "" && conn.writeBufferSize >= expectedBytes
+	}, &dialer)
+	if err != nil {
+		return nil, err
+	}
+	if conn == nil {
+		return p.Acquire(ctx)
+	}
+	conn = p.checkout(conn)
+	p.watchLeak(conn)
+	if p.config.StrictOwnership {
+		conn.owner.Store(goroutineID())
+	}
+	return conn, nil
+}
+
+// AcquireSubprotocol is like Acquire but returns a connection that
+// negotiated the subprotocol proto, for pools whose Dialer offers several.
+// An idle connection speaking proto is preferred; otherwise one is dialed
+// offering only proto, replacing an idle connection if the pool is full.
+// It does not wait for a release: if the pool is saturated it fails with
+// ErrPoolExhausted.
+func (p *Pool) AcquireSubprotocol(ctx context.Context, proto string) (*WsConn, error) {
+	dialer := *p.config.Dialer
+	dialer.Subprotocols = []string{proto}
+	conn, err := p.takeOrDial(ctx, func(conn *WsConn) bool {
+		return conn.target == "" && conn.Subprotocol() == proto
+	}, &dialer)
+	if err != nil {
+		return nil, err
+	}
+	if conn == nil {
+		return nil, ErrPoolExhausted
+	}
+	conn = p.checkout(conn)
+	p.watchLeak(conn)
+	if got := conn.Subprotocol(); got != proto {
+		conn.Release()
+		return nil, fmt.Errorf("server negotiated subprotocol %q, want %q", got, proto)
+	}
+	if p.config.StrictOwnership {
+		conn.owner.Store(goroutineID())
+	}
+	return conn, nil
+}
+
+// takeOrDial takes an idle connection that satisfies match or dials one with
+// dialer, making room by closing another idle connection if the pool is
+// full. It returns nil without an error when neither is possible without
+// waiting.
+func (p *Pool) takeOrDial(ctx context.Context, match func(*WsConn) bool, dialer *websocket.Dialer) (*WsConn, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.sawActivity = true
+	for {
+		if p.closed {
+			return nil, errors.New("pool is closed")
+		}
+		conn := p.takeIdleFunc(match)
+		if conn == nil {
+			break
+		}
+		p.lock.Unlock()
+		alive := conn.ping()
+		p.lock.Lock()
+		if alive {
+			return conn, nil
+		}
+		// Discard the dead connection and look again; its slot is free
+		// for a dial now.
+		p.activeConnections--
+		p.counters.evictions++
+		p.notifyEvict(conn, EvictBroken)
+	}
+
+	// Make room by closing an idle connection that does not match.
+	if p.activeConnections >= p.config.MaxConn {
+		if idle := p.removeOldestIdle(); idle != nil {
+			p.evictIdle(idle, EvictDisplaced)
+		}
+	}
+	if p.activeConnections >= p.config.MaxConn {
+		return nil, nil
+	}
+	return p.newConnectionWith(ctx, "", dialer)
+}
+
+// AcquireN acquires n connections at once. Either all n connections are
+// returned or, if ctx ends or a dial fails first, the connections acquired so
+// far are released and the error is returned. Batch acquisitions are
+// serialized so that two concurrent batches cannot each hold part of the pool
+// while waiting for the rest.
+func (p *Pool) AcquireN(ctx context.Context, n int) ([]*WsConn, error) {
+	if n <= 0 || n > int(p.config.MaxConn) {
+		return nil, errors.New("n must be between 1 and MaxConn")
+	}
+	p.batchLock.Lock()
+	defer p.batchLock.Unlock()
+
+	conns := make([]*WsConn, 0, n)
+	for len(conns) < n {
+		conn, err := p.Acquire(ctx)
+		if err != nil {
+			for _, c := range conns {
+				c.Release()
+			}
+			return nil, err
+		}
+		conns = append(conns, conn)
+	}
+	return conns, nil
+}
+
+// acquire implements Acquire, AcquireURL and TryAcquire. An empty url
+// selects the configured URL; policy applies when the pool is saturated.
+func (p *Pool) acquire(ctx context.Context, url string, policy SaturationPolicy) (*WsConn, error) {
+	conn, err := p.acquireConn(ctx, url, policy)
+	if err != nil {
+		return nil, err
+	}
+	conn = p.checkout(conn)
+	p.watchLeak(conn)
+	if p.config.StrictOwnership {
+		conn.owner.Store(goroutineID())
+	}
+	return conn, nil
+}
+
+// checkout starts a new acquisition of conn and returns the handle for it.
+func (p *Pool) checkout(conn *WsConn) *WsConn {
+	conn.uses.Add(1)
+	token := p.lastLease.Add(1)
+	conn.lease.Store(token)
+	return &WsConn{pooledConn: conn.pooledConn, token: token}
+}
+
+// watchLeak arms the MaxAcquireDuration timer for the current acquisition of
+// conn, recording the acquiring goroutine's stack. The timer is stopped by
+// ReleaseLease.
+func (p *Pool) watchLeak(conn *WsConn) {
+	if p.config.MaxAcquireDuration <= 0 {
+		return
+	}
+	token := conn.token
+	stack := debug.Stack()
+	conn.leakTimer.Store(time.AfterFunc(p.config.MaxAcquireDuration, func() {
+		defer p.recoverPanic()
+		if conn.lease.Load() != token {
+			return
+		}
+		if p.config.OnLeak != nil {
+			p.config.OnLeak(conn, stack)
+		}
+		if p.config.ReclaimLeaks {
+			conn.evictReason.CompareAndSwap(0, int32(EvictLeaked))
+			// Unblock a read in progress so that the release can take mu.
+			conn.CancelRead()
+			conn.ReleaseLease(token)
+		}
+	}))
+}
+
+// acquireConn takes an idle connection, dials a new one or waits for one to
+// be released, whichever comes first.
+func (p *Pool) acquireConn(ctx context.Context, url string, policy SaturationPolicy) (*WsConn, error) {
+	for {
+		p.lock.Lock()
+		p.sawActivity = true
+		target := p.targetFor(url)
+
+		if p.closed {
+			p.lock.Unlock()
+			return nil, errors.New("pool is closed")
+		}
+
+		// Reuse an idle connection.
+		if conn := p.takeIdle(target); conn != nil {
+			p.lock.Unlock()
+
+			if !conn.ping() {
+				// Connection is dead; discard and retry.
+				p.lock.Lock()
+				p.activeConnections--
+				p.counters.evictions++
+				p.notifyEvict(conn, EvictBroken)
+				p.lock.Unlock()
+				continue
+			}
+			return conn, nil
+		}
+
+		// At capacity, make room by closing an idle connection that belongs
+		// to another sub-pool.
+		if p.activeConnections >= p.config.MaxConn {
+			if conn := p.removeOldestIdle(); conn != nil {
+				p.evictIdle(conn, EvictDisplaced)
+			}
+		}
+
+		// Create a new connection if capacity allows.
+		if p.activeConnections < p.config.MaxConn && p.config.MaxPendingDials > 0 {
+			if p.pendingDials >= p.config.MaxPendingDials {
+				if policy != SaturationBlock {
+					p.lock.Unlock()
+					return nil, p.rejectSaturated(policy)
+				}
+				if p.dialDone == nil {
+					p.dialDone = make(chan struct{})
+				}
+				done := p.dialDone
+				p.lock.Unlock()
+				select {
+				case <-done:
+					continue
+				case <-ctx.Done():
+					return nil, ctx.Err()
+				}
+			}
+			conn, err := p.dialUnlocked(ctx, target)
+			if err != nil {
+				return nil, err
+			}
+			return conn, nil
+		}
+		if p.activeConnections < p.config.MaxConn {
+			conn, err := p.newConnection(ctx, target)
+			p.lock.Unlock()
+			if err != nil {
+				return nil, err
+			}
+			return conn, nil
+		}
+
+		// Pool is at capacity — apply the saturation policy.
+		if policy != SaturationBlock {
 			p.lock.Unlock()
+			return nil, p.rejectSaturated(policy)
+		}
+
+		// Register as a waiter and block.
+		w := &waiter{target: target, ch: make(chan *WsConn, 1), priority: priorityFrom(ctx)}
+		p.waiters = slices.Insert(p.waiters, p.waiterPos(w.priority), w)
+		p.counters.waits++
+		p.lock.Unlock()
+
+		select {
+		case conn := <-w.ch:
+			if conn == nil {
+				continue
+			}
+			if !conn.ping() {
+				p.lock.Lock()
+				p.activeConnections--
+				p.counters.evictions++
+				p.notifyEvict(conn, EvictBroken)
+				p.lock.Unlock()
+				continue
+			}
+			return conn, nil
+		case <-ctx.Done():
+			p.removeWaiter(w)
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// rejectSaturated returns the error of a non-blocking saturation policy,
+// calling OnShed for SaturationShed. Must be called without p.lock held.
+func (p *Pool) rejectSaturated(policy SaturationPolicy) error {
+	if policy == SaturationShed {
+		if p.config.OnShed != nil {
+			p.config.OnShed()
+		}
+		return ErrShed
+	}
+	return ErrPoolExhausted
+}
+
+// targetFor returns the sub-pool key for url. Must be called with p.lock held.
+func (p *Pool) targetFor(url string) string {
+	if url == p.config.URL {
+		return ""
+	}
+	return url
+}
+
+// takeIdle removes and returns the next idle connection for target, the most
+// recently released one with the default store, or nil if there is none.
+// Must be called with p.lock held.
+func (p *Pool) takeIdle(target string) *WsConn {
+	return p.takeIdleFunc(func(conn *WsConn) bool { return conn.target == target })
+}
+
+// takeIdleFunc removes and returns the next idle connection that satisfies
+// match, or nil if there is none. Must be called with p.lock held.
+func (p *Pool) takeIdleFunc(match func(*WsConn) bool) *WsConn {
+	return p.idle.Get(match)
+}
+
+// removeWaiter removes w from the waiters list and returns any connection
+// that arrived just before the context was cancelled back to the pool.
+func (p *Pool) removeWaiter(w *waiter) {
+	p.lock.Lock()
+	for i, pw := range p.waiters {
+		if pw == w {
+			p.waiters = append(p.waiters[:i], p.waiters[i+1:]...)
+			break
+		}
+	}
+	p.lock.Unlock()
+
+	// Drain: a connection may have been sent between ctx cancellation and
+	// waiter removal. If so, return it to the pool.
+	select {
+	case conn := <-w.ch:
+		if conn != nil {
+			p.release(conn)
+		}
+	default:
+	}
+}
+
+// release returns a connection to the pool.
+func (p *Pool) release(conn *WsConn) {
+	conn.owner.Store(0)
+	conn.readOnly.Store(false)
+	if p.config.ShouldPoolOnRelease != nil && !conn.broken.Load() && !p.config.ShouldPoolOnRelease(conn) {
+		conn.evictReason.CompareAndSwap(0, int32(EvictRecycled))
+		conn.broken.Store(true)
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.closed {
+		conn.disconnect()
+		p.activeConnections--
+		return
+	}
+
+	if p.isDrained(conn) {
+		conn.evictReason.CompareAndSwap(0, int32(EvictRotated))
+		conn.broken.Store(true)
+	}
+
+	// Invalidated connections are never reused. The freed capacity goes to
+	// the first waiter, which retries and dials a fresh connection.
+	if conn.broken.Load() {
+		reason := EvictReason(conn.evictReason.Load())
+		if reason == 0 {
+			reason = EvictBroken
+		}
+		p.notifyEvict(conn, reason)
+		if reason == EvictExpired {
+			if !p.closeExpired(conn) {
+				return
+			}
+		} else {
+			conn.disconnect()
+			p.activeConnections--
+		}
+		if !p.wakeWaiter() {
+			p.maintainPoolSize()
+		}
+		return
+	}
+
+	// Hand the connection directly to a waiter for the same sub-pool.
+	// maintainPoolSize is not called here: the connection remains active
+	// (owned by the waiter), so pool size is unchanged.
+	if p.handToWaiter(conn) {
+		return
+	}
+
+	// Remaining waiters want another sub-pool and are blocked on capacity,
+	// so give them this connection's slot instead of pooling it.
+	if len(p.waiters) > 0 {
+		conn.disconnect()
+		p.activeConnections--
+		p.wakeWaiter()
+		return
+	}
+
+	if int32(p.idle.Len()) < p.config.MaxConn {
+		p.idle.Put(conn)
+	} else {
+		conn.disconnect()
+		p.activeConnections--
+	}
+
+	p.maintainPoolSize()
+}
+
+// handToWaiter passes conn to the first waiter for its sub-pool and reports
+// whether there was one. Must be called with p.lock held.
+func (p *Pool) handToWaiter(conn *WsConn) bool {
+	for i, w := range p.waiters {
+		if w.target == conn.target {
+			p.waiters = append(p.waiters[:i], p.waiters[i+1:]...)
+			w.ch <- conn
+			return true
+		}
+	}
+	return false
+}
+
+// wakeWaiter tells the first waiter that capacity was freed so that it
+// retries. It reports whether there was a waiter to wake.
+// Must be called with p.lock held.
+func (p *Pool) wakeWaiter() bool {
+	if len(p.waiters) == 0 {
+		return false
+	}
+	w := p.waiters[0]
+	p.waiters = p.waiters[1:]
+	w.ch <- nil
+	return true
+}
+
+// Invalidate forces conn out of the pool so that it is never reused.
+// An idle connection is closed immediately; an acquired one is marked and
+// closed when it is released. Connections of the reader and writer
+// sub-pools are invalidated in their sub-pool.
+func (p *Pool) Invalidate(conn *WsConn) {
+	if conn == nil {
+		return
+	}
+	if conn.p != p {
+		if slices.Contains(p.roles(), conn.p) {
+			conn.p.Invalidate(conn)
+		}
+		return
+	}
+	conn.evictReason.CompareAndSwap(0, int32(EvictInvalidated))
+	conn.broken.Store(true)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.idle.Remove(conn) {
+		conn.disconnect()
+		p.activeConnections--
+		p.notifyEvict(conn, EvictInvalidated)
+		p.maintainPoolSize()
+	}
+}
+
+// DrainURL retires every connection established to oldURL and dials
+// replacements against newURL, e.g. to move traffic off a backend during a
+// blue/green switch. Idle connections are replaced immediately; acquired ones
+// are closed when released. If oldURL is the configured URL or one of URLs,
+// newURL takes its place. Replacement dialing stops early if ctx is cancelled.
+// The reader and writer sub-pools are drained first.
+func (p *Pool) DrainURL(ctx context.Context, oldURL, newURL string) error {
+	for _, role := range p.roles() {
+		if err := role.DrainURL(ctx, oldURL, newURL); err != nil {
+			return err
+		}
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.closed {
+		return errors.New("pool is closed")
+	}
+	if p.config.URL == oldURL {
+		p.config.URL = newURL
+	}
+	for i, url := range p.config.URLs {
+		if url == oldURL {
+			p.config.URLs[i] = newURL
+		}
+	}
+	if p.drained == nil {
+		p.drained = make(map[string]time.Time)
+	}
+	p.drained[oldURL] = time.Now()
+
+	var retired []*WsConn
+	for _, conn := range p.idleConns() {
+		if conn.url == oldURL {
+			p.idle.Remove(conn)
+			retired = append(retired, conn)
+		}
+	}
+
+	for _, conn := range retired {
+		conn.disconnect()
+		p.activeConnections--
+		p.notifyEvict(conn, EvictRotated)
+	}
+	for _, conn := range retired {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		target := conn.target
+		if target != "" {
+			target = p.targetFor(newURL)
+		}
+		fresh, err := p.newConnection(ctx, target)
+		if err != nil {
+			return err
+		}
+		p.idle.Put(fresh)
+	}
+	return nil
+}
+
+// isDrained reports whether conn was established to a URL that has since
+// been drained by DrainURL. Must be called with p.lock held.
+func (p *Pool) isDrained(conn *WsConn) bool {
+	drainedAt, ok := p.drained[conn.url]
+	return ok && !conn.createdAt.After(drainedAt)
+}
+
+// Close closes all connections in the pool. It returns the errors from
+// connections that failed to close, joined together, and nil on subsequent
+// calls. Pool implements io.Closer.
+func (p *Pool) Close() error {
+	var errs []error
+	p.closeOnce.Do(func() {
+		close(p.closeChan)
+		p.lock.Lock()
+		defer p.lock.Unlock()
+
+		p.closed = true
+		for _, conn := range p.idleConns() {
+			p.idle.Remove(conn)
+			if err := conn.disconnect(); err != nil {
+				errs = append(errs, err)
+			}
+			p.activeConnections--
+		}
+	})
+	for _, role := range p.roles() {
+		errs = append(errs, role.Close())
+	}
+	return errors.Join(errs...)
+}
+
+var _ io.Closer = (*Pool)(nil)
+
+// DrainOnSignal closes the pool when one of sig is received, so that a
+// service can shut the pool down gracefully on SIGTERM with one call. Idle
+// connections are closed immediately and acquired ones when they are
+// released. Without arguments it listens for os.Interrupt and SIGTERM.
+// The returned function stops listening.
+func (p *Pool) DrainOnSignal(sig ...os.Signal) (stop func()) {
+	if len(sig) == 0 {
+		sig = []os.Signal{os.Interrupt, syscall.SIGTERM}
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sig...)
+
+	done := make(chan struct{})
+	go func() {
+		defer signal.Stop(ch)
+		select {
+		case <-ch:
+			p.Close()
+		case <-done:
+		case <-p.closeChan:
+		}
+	}()
+
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+// Stats returns a snapshot of the current pool state, including the reader
+// and writer sub-pools.
+func (p *Pool) Stats() Stats {
+	p.lock.Lock()
+	stats := Stats{
+		IdleConns:         int32(p.idle.Len()),
+		ActiveConns:       p.activeConnections,
+		MaxConns:          p.config.MaxConn,
+		DialCount:         p.counters.dials,
+		DialErrorCount:    p.counters.dialErrors,
+		EvictCount:        p.counters.evictions,
+		WaitCount:         p.counters.waits,
+		Saturation:        p.saturation(),
+		RetireCount:       p.retired.Load(),
+		HealthCheckPeriod: p.healthPeriod,
+	}
+	if stats.RetireCount > 0 {
+		stats.AvgUsesBeforeRetire = float64(p.retiredUses.Load()) / float64(stats.RetireCount)
+	}
+	p.lock.Unlock()
+
+	for _, role := range p.roles() {
+		stats.add(role.Stats())
+	}
+	return stats
+}
+
+// add merges the stats of a sub-pool into s.
+func (s *Stats) add(o Stats) {
+	uses := s.AvgUsesBeforeRetire*float64(s.RetireCount) + o.AvgUsesBeforeRetire*float64(o.RetireCount)
+	s.IdleConns += o.IdleConns
+	s.ActiveConns += o.ActiveConns
+	s.MaxConns += o.MaxConns
+	s.Saturation = float64(s.ActiveConns) / float64(s.MaxConns)
+	s.DialCount += o.DialCount
+	s.DialErrorCount += o.DialErrorCount
+	s.EvictCount += o.EvictCount
+	s.WaitCount += o.WaitCount
+	s.RetireCount += o.RetireCount
+	if s.RetireCount > 0 {
+		s.AvgUsesBeforeRetire = uses / float64(s.RetireCount)
+	}
+}
+
+// Saturation returns the share of MaxConn currently open, from 0 (no
+// connections) to 1 (at capacity), as a gauge for autoscaling. The reader
+// and writer sub-pools count towards both.
+func (p *Pool) Saturation() float64 {
+	return p.Stats().Saturation
+}
+
+// saturation implements Saturation. Must be called with p.lock held.
+func (p *Pool) saturation() float64 {
+	return float64(p.activeConnections) / float64(p.config.MaxConn)
+}
+
+// recordRetirement counts a closed connection that was acquired uses times.
+func (p *Pool) recordRetirement(uses int64) {
+	p.retiredUses.Add(uses)
+	p.retired.Add(1)
+}
+
+// dedupEntry is a key claimed by SendJSONDedup and when it was claimed.
+type dedupEntry struct {
+	key    string
+	sentAt time.Time
+}
+
+// dedupClaim records key as sent and reports whether it was not already
+// recorded within the dedup window. Expired keys are pruned on the way,
+// oldest first, so a claim only visits the keys that expired.
+func (p *Pool) dedupClaim(key string) bool {
+	window := p.config.DedupWindow
+	if window <= 0 {
+		window = defaultDedupWindow
+	}
+
+	p.dedupLock.Lock()
+	defer p.dedupLock.Unlock()
+
+	now := time.Now()
+	for len(p.dedupOrder) > 0 && now.Sub(p.dedupOrder[0].sentAt) >= window {
+		e := p.dedupOrder[0]
+		p.dedupOrder = p.dedupOrder[1:]
+		// The key may have been forgotten and claimed again since.
+		if p.dedup[e.key].Equal(e.sentAt) {
+			delete(p.dedup, e.key)
+		}
+	}
+	if _, ok := p.dedup[key]; ok {
+		return false
+	}
+	if p.dedup == nil {
+		p.dedup = make(map[string]time.Time)
+	}
+	p.dedup[key] = now
+	p.dedupOrder = append(p.dedupOrder, dedupEntry{key: key, sentAt: now})
+	return true
+}
+
+// dedupForget removes key so that a failed send can be retried. Its entry in
+// dedupOrder is skipped when it expires.
+func (p *Pool) dedupForget(key string) {
+	p.dedupLock.Lock()
+	defer p.dedupLock.Unlock()
+	delete(p.dedup, key)
+}
+
+// ConnDebugInfo describes one pooled connection in a DebugSnapshot.
+type ConnDebugInfo struct {
+	// ID is the connection's ID as returned by WsConn.ID.
+	ID string
+	// URL is the URL the connection was dialed to.
+	URL string
+	// RemoteAddr is the server address, or empty if the socket is closed.
+	RemoteAddr string
+	// Age is the time since the connection was created.
+	Age time.Duration
+	// IdleTime is the time the connection has spent idle in the pool, see
+	// WsConn.PooledSince.
+	IdleTime time.Duration
+	// Broken reports whether the connection is marked for close on release.
+	Broken bool
+	// UsageCount is the number of times the connection has been acquired.
+	UsageCount int64
+	// LastError is the connection's LastError.
+	LastError error
+}
+
+// DebugSnapshot returns a read-only view of the idle connections currently
+// held by the pool and its reader and writer sub-pools, for diagnostics and
+// bug reports.
+func (p *Pool) DebugSnapshot() []ConnDebugInfo {
+	infos := p.debugSnapshot()
+	for _, role := range p.roles() {
+		infos = append(infos, role.debugSnapshot()...)
+	}
+	return infos
+}
+
+// debugSnapshot implements DebugSnapshot for the idle connections of p.
+func (p *Pool) debugSnapshot() []ConnDebugInfo {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	now := time.Now()
+	infos := make([]ConnDebugInfo, 0, p.idle.Len())
+	for _, conn := range p.idleConns() {
+		conn.mu.Lock()
+		info := ConnDebugInfo{
+			ID:         conn.id,
+			URL:        conn.url,
+			Age:        now.Sub(conn.createdAt),
+			IdleTime:   now.Sub(conn.PooledSince()),
+			Broken:     conn.broken.Load(),
+			UsageCount: conn.uses.Load(),
+			LastError:  conn.LastError(),
+		}
+		if conn.c != nil {
+			info.RemoteAddr = conn.c.RemoteAddr().String()
+		}
+		conn.mu.Unlock()
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// ResetStats zeroes the cumulative counters reported by Stats, e.g. after
+// they have been scraped. Gauges such as IdleConns and ActiveConns are not
+// affected.
+func (p *Pool) ResetStats() {
+	for _, role := range p.roles() {
+		role.ResetStats()
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.counters = counters{}
+	p.retired.Store(0)
+	p.retiredUses.Store(0)
+}
+
+// maintainPoolSize ensures the idle pool stays between MinIdleConn and MaxConn.
+func (p *Pool) maintainPoolSize() {
+	for int32(p.idle.Len()) < p.config.MinIdleConn && p.activeConnections < p.config.MaxConn {
+		conn, err := p.newConnection(context.Background(), "")
+		if err != nil {
+			p.reportError(fmt.Errorf("dialing idle connection: %w", err))
+			break
+		}
+		p.idle.Put(conn)
+	}
+
+	for int32(p.idle.Len()) > p.config.MaxConn {
+		conn := p.idle.Get(func(*WsConn) bool { return true })
+		p.evictIdle(conn, EvictSurplus)
+	}
+}
+
+// staleReason reports why an idle connection should be evicted by the health
+// check, or zero if it should be kept.
+func (p *Pool) staleReason(conn *WsConn, now time.Time) EvictReason {
+	// Under LifetimeStagger, lifetime expiry is left to the expiry timers.
+	if p.config.MaxConnLifetime > 0 && p.config.LifetimeStagger == 0 && now.Sub(conn.createdAt) > p.config.MaxConnLifetime {
+		return EvictExpired
+	}
+	if p.config.MaxConnIdleTime > 0 && now.Sub(conn.PooledSince()) > p.config.MaxConnIdleTime {
+		return EvictIdle
+	}
+	return 0
+}
+
+// Errors returns a channel of non-fatal errors from the pool's background
+// work, such as failed dials while topping up MinIdleConn and abandoned
+// reconnects, so that services can monitor them without polling Stats. The
+// channel holds the latest 64 errors: when it is full the oldest is dropped.
+// It is never closed. Errors of the reader and writer sub-pools are
+// delivered on it too.
+func (p *Pool) Errors() <-chan error {
+	return p.errs
+}
 
+// reportError delivers err on the Errors channel, dropping the oldest error
+// if nobody is keeping up.
+func (p *Pool) reportError(err error) {
+	p.errsLock.Lock()
+	defer p.errsLock.Unlock()
+	for {
+		select {
+		case p.errs <- err:
+			return
+		default:
+		}
+		select {
+		case <-p.errs:
+		default:
+		}
+	}
+}
+
+// rememberPredecessor keeps a connection retired for reason so that its
+// state can be passed to TransferState, dropping the oldest beyond MaxConn.
+// Must be called with p.lock held.
+func (p *Pool) rememberPredecessor(conn *WsConn, reason EvictReason) {
+	if p.config.TransferState == nil {
+		return
+	}
+	switch reason {
+	case EvictExpired, EvictRotated, EvictBroken:
+		p.predecessors = append(p.predecessors, conn)
+		if len(p.predecessors) > int(p.config.MaxConn) {
+			p.predecessors = p.predecessors[1:]
+		}
+	}
+}
+
+// takePredecessor removes and returns the oldest remembered connection for
+// target, or nil. Must be called with p.lock held.
+func (p *Pool) takePredecessor(target string) *WsConn {
+	for i, conn := range p.predecessors {
+		if conn.target == target {
+			p.predecessors = slices.Delete(p.predecessors, i, i+1)
+			return conn
+		}
+	}
+	return nil
+}
+
+// evictIdle closes conn, which was just taken out of the idle store, and
+// counts and reports it as evicted for reason. Must be called with p.lock
+// held.
+func (p *Pool) evictIdle(conn *WsConn, reason EvictReason) {
+	conn.disconnect()
+	p.activeConnections--
+	p.counters.evictions++
+	p.notifyEvict(conn, reason)
+}
+
+// notifyEvict reports an eviction to OnEvict without blocking the caller,
+// which usually holds p.lock.
+func (p *Pool) notifyEvict(conn *WsConn, reason EvictReason) {
+	p.rememberPredecessor(conn, reason)
+	if p.config.OnEvict == nil {
+		return
+	}
+	go func() {
+		defer p.recoverPanic()
+		p.config.OnEvict(conn, reason)
+	}()
+}
+
+func (p *Pool) startHealthCheck() {
+	timer := time.NewTimer(p.config.HealthCheckPeriod)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+		case <-p.resumeChan:
 		case <-p.closeChan:
 			return
 		}
+		timer.Reset(p.runHealthCheck())
+	}
+}
+
+// runHealthCheck runs checkHealth, recovering from a panic in a hook it calls
+// so that the health check keeps running.
+func (p *Pool) runHealthCheck() (next time.Duration) {
+	next = p.config.HealthCheckPeriod
+	defer p.recoverPanic()
+	next = p.checkHealth()
+	if p.config.AppPingMessage != nil {
+		p.verifyIdle()
+	}
+	return next
+}
+
+// verifyIdle pings every idle connection and evicts those that fail. Each
+// connection is taken out of the pool only while it is pinged, so that the
+// others stay available.
+func (p *Pool) verifyIdle() {
+	p.lock.Lock()
+	if p.healthPaused {
+		p.lock.Unlock()
+		return
+	}
+	idle := p.idleConns()
+	p.lock.Unlock()
+
+	for _, conn := range idle {
+		p.lock.Lock()
+		// Skip connections acquired since the snapshot.
+		if p.closed || !p.idle.Remove(conn) {
+			p.lock.Unlock()
+			continue
+		}
+		p.lock.Unlock()
+
+		if !conn.verify() {
+			conn.evictReason.CompareAndSwap(0, int32(EvictBroken))
+			conn.broken.Store(true)
+			p.lock.Lock()
+			p.counters.evictions++
+			p.lock.Unlock()
+			p.release(conn)
+			continue
+		}
+
+		// Put a live connection back as it was, bypassing the release
+		// policies that apply to connections coming back from a holder.
+		p.lock.Lock()
+		if p.closed {
+			conn.disconnect()
+			p.activeConnections--
+		} else if !p.handToWaiter(conn) {
+			p.idle.Put(conn)
+		}
+		p.lock.Unlock()
+	}
+}
+
+// recoverPanic reports a panic in a background goroutine instead of crashing
+// the process. It must be deferred directly.
+func (p *Pool) recoverPanic() {
+	if v := recover(); v != nil {
+		p.reportPanic(v)
+	}
+}
+
+// reportPanic passes a recovered panic to OnPanic, or logs it.
+func (p *Pool) reportPanic(v any) {
+	if p.config.OnPanic != nil {
+		p.config.OnPanic(v)
+		return
+	}
+	log.Printf("wspool: recovered panic in background goroutine: %v\n%s", v, debug.Stack())
+}
+
+// checkHealth evicts idle connections that are idle for too long or expired
+// and tops the pool back up, unless the health check is paused. It returns
+// the delay until the next check.
+func (p *Pool) checkHealth() time.Duration {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.adaptHealthPeriod()
+	if p.healthPaused {
+		return p.healthPeriod
+	}
+
+	now := time.Now()
+	for _, conn := range p.idleConns() {
+		if reason := p.staleReason(conn, now); reason != 0 {
+			p.idle.Remove(conn)
+			p.counters.evictions++
+			p.notifyEvict(conn, reason)
+			if reason == EvictExpired {
+				p.closeExpired(conn)
+			} else {
+				conn.disconnect()
+				p.activeConnections--
+			}
+		}
+	}
+
+	p.maintainPoolSize()
+	return p.healthPeriod
+}
+
+// adaptHealthPeriod doubles the health check period, up to
+// MaxHealthCheckPeriod, when the pool saw no acquisitions since the last
+// check and snaps it back to HealthCheckPeriod when it did.
+// Must be called with p.lock held.
+func (p *Pool) adaptHealthPeriod() {
+	if !p.config.AdaptiveHealthCheck {
+		return
+	}
+	if p.sawActivity {
+		p.healthPeriod = p.config.HealthCheckPeriod
+	} else {
+		p.healthPeriod = min(2*p.healthPeriod, p.config.MaxHealthCheckPeriod)
+	}
+	p.sawActivity = false
+}
+
+// PauseHealthCheck stops the health check from evicting or replacing
+// connections, e.g. during a maintenance window, until ResumeHealthCheck is
+// called. Lifetime expiry of idle connections is not affected. The reader
+// and writer sub-pools are paused as well.
+func (p *Pool) PauseHealthCheck() {
+	for _, role := range p.roles() {
+		role.PauseHealthCheck()
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.healthPaused = true
+}
+
+// ResumeHealthCheck undoes PauseHealthCheck and runs a health check right
+// away instead of waiting for the next tick.
+func (p *Pool) ResumeHealthCheck() {
+	for _, role := range p.roles() {
+		role.ResumeHealthCheck()
+	}
+	p.lock.Lock()
+	p.healthPaused = false
+	p.lock.Unlock()
+
+	select {
+	case p.resumeChan <- struct{}{}:
+	default:
 	}
 }
@@ -1,10 +1,20 @@
 package wspool
 
 import (
+	"compress/flate"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -15,8 +25,9 @@ var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool { return true },
 }
 
-// newEchoServer starts a local WebSocket echo server and returns its ws:// URL.
-func newEchoServer(t *testing.T) string {
+// newServer starts a local WebSocket server that runs handler for every
+// upgraded connection and returns its ws:// URL.
+func newServer(t testing.TB, handler func(conn *websocket.Conn)) string {
 	t.Helper()
 	mux := http.NewServeMux()
 	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
@@ -25,6 +36,17 @@ func newEchoServer(t *testing.T) string {
 			return
 		}
 		defer conn.Close()
+		handler(conn)
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+}
+
+// newEchoServer starts a local WebSocket echo server and returns its ws:// URL.
+func newEchoServer(t testing.TB) string {
+	t.Helper()
+	return newServer(t, func(conn *websocket.Conn) {
 		for {
 			mt, msg, err := conn.ReadMessage()
 			if err != nil {
@@ -35,15 +57,14 @@ func newEchoServer(t *testing.T) string {
 			}
 		}
 	})
-	srv := httptest.NewServer(mux)
-	t.Cleanup(srv.Close)
-	return "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
 }
 
 // newPool creates a pool pointed at url with test-safe defaults and registers cleanup.
 func newPool(t *testing.T, url string, cfg Config) *Pool {
 	t.Helper()
-	cfg.Dialer = websocket.DefaultDialer
+	if cfg.Dialer == nil {
+		cfg.Dialer = websocket.DefaultDialer
+	}
 	cfg.URL = url
 	if cfg.HealthCheckPeriod == 0 {
 		cfg.HealthCheckPeriod = time.Hour
@@ -52,7 +73,7 @@ func newPool(t *testing.T, url string, cfg Config) *Pool {
 	if err != nil {
 		t.Fatalf("New: %v", err)
 	}
-	t.Cleanup(p.Close)
+	t.Cleanup(func() { p.Close() })
 	return p
 }
 
@@ -60,7 +81,7 @@ func newPool(t *testing.T, url string, cfg Config) *Pool {
 func idleCount(p *Pool) int {
 	p.lock.Lock()
 	defer p.lock.Unlock()
-	return len(p.conns)
+	return p.idle.Len()
 }
 
 func TestNew_InvalidConfig(t *testing.T) {
@@ -74,6 +95,22 @@ func TestNew_InvalidConfig(t *testing.T) {
 		{"zero HealthCheckPeriod", Config{Dialer: websocket.DefaultDialer, URL: url, MaxConn: 1}},
 		{"zero MaxConn", Config{Dialer: websocket.DefaultDialer, URL: url, HealthCheckPeriod: time.Second}},
 		{"MinConn > MaxConn", Config{Dialer: websocket.DefaultDialer, URL: url, MinConn: 5, MaxConn: 2, HealthCheckPeriod: time.Second}},
+		{"MinIdleConn > MaxConn", Config{Dialer: websocket.DefaultDialer, URL: url, MinIdleConn: 3, MaxConn: 2, HealthCheckPeriod: time.Second}},
+		{"invalid DefaultMessageType", Config{Dialer: websocket.DefaultDialer, URL: url, MaxConn: 1, HealthCheckPeriod: time.Second, DefaultMessageType: websocket.PingMessage}},
+		{"negative OnNewConnRetries", Config{Dialer: websocket.DefaultDialer, URL: url, MaxConn: 1, HealthCheckPeriod: time.Second, OnNewConnRetries: -1}},
+		{"invalid ExpiryPolicy", Config{Dialer: websocket.DefaultDialer, URL: url, MaxConn: 1, HealthCheckPeriod: time.Second, ExpiryPolicy: 5}},
+		{"negative LifetimeStagger", Config{Dialer: websocket.DefaultDialer, URL: url, MaxConn: 1, HealthCheckPeriod: time.Second, LifetimeStagger: -1}},
+		{"negative MaxReconnectAttempts", Config{Dialer: websocket.DefaultDialer, URL: url, MaxConn: 1, HealthCheckPeriod: time.Second, MaxReconnectAttempts: -1}},
+		{"negative FollowRedirects", Config{Dialer: websocket.DefaultDialer, URL: url, MaxConn: 1, HealthCheckPeriod: time.Second, FollowRedirects: -1}},
+		{"negative DrainTimeout", Config{Dialer: websocket.DefaultDialer, URL: url, MaxConn: 1, HealthCheckPeriod: time.Second, DrainTimeout: -1}},
+		{"negative MaxAcquireDuration", Config{Dialer: websocket.DefaultDialer, URL: url, MaxConn: 1, HealthCheckPeriod: time.Second, MaxAcquireDuration: -1}},
+		{"negative MaxReaders", Config{Dialer: websocket.DefaultDialer, URL: url, MaxConn: 1, HealthCheckPeriod: time.Second, MaxReaders: -1}},
+		{"negative MaxPendingDials", Config{Dialer: websocket.DefaultDialer, URL: url, MaxConn: 1, HealthCheckPeriod: time.Second, MaxPendingDials: -1}},
+		{"invalid WaitQueuePolicy", Config{Dialer: websocket.DefaultDialer, URL: url, MaxConn: 1, HealthCheckPeriod: time.Second, WaitQueuePolicy: 7}},
+		{"AppPingMessage without matcher", Config{Dialer: websocket.DefaultDialer, URL: url, MaxConn: 1, HealthCheckPeriod: time.Second, AppPingMessage: []byte("ping")}},
+		{"CompressionLevel out of range", Config{Dialer: websocket.DefaultDialer, URL: url, MaxConn: 1, HealthCheckPeriod: time.Second, CompressionLevel: 10}},
+		{"URLWeights length mismatch", Config{Dialer: websocket.DefaultDialer, URLs: []string{url}, URLWeights: []int{1, 2}, MaxConn: 1, HealthCheckPeriod: time.Second}},
+		{"non-positive URLWeights", Config{Dialer: websocket.DefaultDialer, URLs: []string{url}, URLWeights: []int{0}, MaxConn: 1, HealthCheckPeriod: time.Second}},
 	}
 	for _, tc := range cases {
 		t.Run(tc.name, func(t *testing.T) {
@@ -119,7 +156,7 @@ func TestAcquire_UpdatesLastUsedAt(t *testing.T) {
 	p := newPool(t, url, Config{MinConn: 1, MaxConn: 2})
 
 	p.lock.Lock()
-	before := p.conns[0].lastUsedAt
+	before := p.idleConns()[0].lastUsedAt
 	p.lock.Unlock()
 
 	time.Sleep(5 * time.Millisecond)
@@ -135,6 +172,27 @@ func TestAcquire_UpdatesLastUsedAt(t *testing.T) {
 	}
 }
 
+func TestRelease_UpdatesPooledSince(t *testing.T) {
+	url := newEchoServer(t)
+	p := newPool(t, url, Config{MinConn: 1, MaxConn: 2})
+
+	p.lock.Lock()
+	before := p.idleConns()[0].PooledSince()
+	p.lock.Unlock()
+
+	time.Sleep(5 * time.Millisecond)
+
+	conn, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	conn.Release()
+
+	if !conn.PooledSince().After(before) {
+		t.Error("PooledSince was not refreshed on Release")
+	}
+}
+
 func TestAcquire_BlocksUntilReleased(t *testing.T) {
 	url := newEchoServer(t)
 	p := newPool(t, url, Config{MaxConn: 1})
@@ -292,8 +350,8 @@ func TestClose_Idempotent(t *testing.T) {
 	p := newPool(t, url, Config{MinConn: 2, MaxConn: 4})
 	p.Close()
 	p.Close() // must not panic
-	if p.conns != nil {
-		t.Errorf("conns not nil after Close, len=%d", len(p.conns))
+	if n := p.idle.Len(); n != 0 {
+		t.Errorf("idle connections left after Close, len=%d", n)
 	}
 }
 
@@ -353,3 +411,3733 @@ func TestHealthCheck_Eviction(t *testing.T) {
 		}
 	})
 }
+
+func TestInvalidate(t *testing.T) {
+	url := newEchoServer(t)
+
+	t.Run("idle", func(t *testing.T) {
+		p := newPool(t, url, Config{MinConn: 1, MaxConn: 1})
+
+		p.lock.Lock()
+		old := p.idleConns()[0]
+		p.lock.Unlock()
+
+		p.Invalidate(old)
+		if old.c != nil {
+			t.Error("invalidated idle connection was not closed")
+		}
+
+		conn, err := p.Acquire(context.Background())
+		if err != nil {
+			t.Fatalf("Acquire: %v", err)
+		}
+		defer conn.Release()
+		if conn == old {
+			t.Error("Acquire returned the invalidated connection")
+		}
+		if got := p.Stats().ActiveConns; got != 1 {
+			t.Errorf("ActiveConns = %d, want 1", got)
+		}
+	})
+
+	t.Run("acquired", func(t *testing.T) {
+		p := newPool(t, url, Config{MaxConn: 1})
+
+		conn, err := p.Acquire(context.Background())
+		if err != nil {
+			t.Fatalf("Acquire: %v", err)
+		}
+		p.Invalidate(conn)
+		if conn.c == nil {
+			t.Fatal("acquired connection was closed before release")
+		}
+		conn.Release()
+
+		s := p.Stats()
+		if s.IdleConns != 0 || s.ActiveConns != 0 {
+			t.Errorf("stats after release = %+v, want no connections", s)
+		}
+	})
+}
+
+func TestClose_Redundant(t *testing.T) {
+	url := newEchoServer(t)
+	p := newPool(t, url, Config{MaxConn: 2})
+
+	t.Run("Close twice", func(t *testing.T) {
+		conn, err := p.Acquire(context.Background())
+		if err != nil {
+			t.Fatalf("Acquire: %v", err)
+		}
+		if err := conn.Close(); err != nil {
+			t.Fatalf("first Close: %v", err)
+		}
+		if err := conn.Close(); err != nil {
+			t.Errorf("second Close: %v", err)
+		}
+	})
+
+	t.Run("CloseWithStatus after Close", func(t *testing.T) {
+		conn, err := p.Acquire(context.Background())
+		if err != nil {
+			t.Fatalf("Acquire: %v", err)
+		}
+		if err := conn.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+		if err := conn.CloseWithStatus(websocket.CloseNormalClosure, "bye"); err != nil {
+			t.Errorf("CloseWithStatus: %v", err)
+		}
+	})
+
+	if got := p.Stats().ActiveConns; got != 0 {
+		t.Errorf("ActiveConns = %d, want 0", got)
+	}
+}
+
+func TestTimeouts_DeadlineClearedAfterOperation(t *testing.T) {
+	url := newEchoServer(t)
+	const timeout = 30 * time.Millisecond
+	p := newPool(t, url, Config{MaxConn: 1, WriteTimeout: timeout})
+
+	conn, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	defer conn.Release()
+
+	if err := conn.SendMessage("first"); err != nil {
+		t.Fatalf("timed SendMessage: %v", err)
+	}
+	// Outlive the write deadline; a stale deadline would fail the calls below.
+	time.Sleep(3 * timeout)
+
+	got, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("untimed ReadMessage: %v", err)
+	}
+	if string(got) != "first" {
+		t.Errorf("got %q, want %q", got, "first")
+	}
+	if err := conn.SendMessage("second"); err != nil {
+		t.Fatalf("second SendMessage: %v", err)
+	}
+	if _, err := conn.ReadMessage(); err != nil {
+		t.Fatalf("second ReadMessage: %v", err)
+	}
+}
+
+func TestAcquireURL_SegregatesByURL(t *testing.T) {
+	urlA := newEchoServer(t)
+	urlB := newEchoServer(t)
+	p := newPool(t, urlA, Config{MaxConn: 2})
+
+	a, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	b, err := p.AcquireURL(context.Background(), urlB)
+	if err != nil {
+		t.Fatalf("AcquireURL: %v", err)
+	}
+	if a.URL() != urlA || b.URL() != urlB {
+		t.Fatalf("URLs = %q, %q; want %q, %q", a.URL(), b.URL(), urlA, urlB)
+	}
+	a.Release()
+	b.Release()
+
+	// Each sub-pool must hand back its own idle connection.
+	b2, err := p.AcquireURL(context.Background(), urlB)
+	if err != nil {
+		t.Fatalf("AcquireURL: %v", err)
+	}
+	if b2.pooledConn != b.pooledConn {
+		t.Error("AcquireURL did not reuse the idle connection to its URL")
+	}
+	a2, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	if a2.pooledConn != a.pooledConn {
+		t.Error("Acquire did not reuse the idle connection to the configured URL")
+	}
+	a2.Release()
+	b2.Release()
+
+	if got := p.Stats().ActiveConns; got != 2 {
+		t.Errorf("ActiveConns = %d, want 2", got)
+	}
+}
+
+func TestAcquireURL_SharesMaxConn(t *testing.T) {
+	urlA := newEchoServer(t)
+	urlB := newEchoServer(t)
+	p := newPool(t, urlA, Config{MaxConn: 1})
+
+	a, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		a.Release()
+	}()
+
+	// The waiter for urlB gets the slot freed by the urlA connection.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	b, err := p.AcquireURL(ctx, urlB)
+	if err != nil {
+		t.Fatalf("AcquireURL: %v", err)
+	}
+	defer b.Release()
+	if b.URL() != urlB {
+		t.Errorf("URL = %q, want %q", b.URL(), urlB)
+	}
+	if got := p.Stats().ActiveConns; got != 1 {
+		t.Errorf("ActiveConns = %d, want 1", got)
+	}
+}
+
+func TestDrainURL_ReplacesConnections(t *testing.T) {
+	urlA := newEchoServer(t)
+	urlB := newEchoServer(t)
+	p := newPool(t, urlA, Config{MinConn: 2, MaxConn: 3})
+
+	inUse, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+
+	if err := p.DrainURL(context.Background(), urlA, urlB); err != nil {
+		t.Fatalf("DrainURL: %v", err)
+	}
+	if inUse.c == nil {
+		t.Fatal("acquired connection was closed before release")
+	}
+	inUse.Release()
+	if inUse.c != nil {
+		t.Error("drained connection was not closed on release")
+	}
+
+	p.lock.Lock()
+	for _, conn := range p.idleConns() {
+		if conn.url != urlB {
+			t.Errorf("idle connection to %q, want %q", conn.url, urlB)
+		}
+	}
+	p.lock.Unlock()
+
+	conn, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire after drain: %v", err)
+	}
+	defer conn.Release()
+	if conn.URL() != urlB {
+		t.Errorf("URL = %q, want %q", conn.URL(), urlB)
+	}
+}
+
+func TestReadJSONStream(t *testing.T) {
+	type event struct {
+		Seq int `json:"seq"`
+	}
+	url := newServer(t, func(conn *websocket.Conn) {
+		for i := 1; i <= 3; i++ {
+			if err := conn.WriteJSON(event{Seq: i}); err != nil {
+				return
+			}
+		}
+		// Returning closes the connection, which must end the stream with an error.
+	})
+	p := newPool(t, url, Config{MaxConn: 1})
+
+	conn, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	defer conn.Release()
+
+	values, errs := ReadJSONStream[event](conn)
+	var got []int
+	for v := range values {
+		got = append(got, v.Seq)
+	}
+	if len(got) != 3 || got[0] != 1 || got[1] != 2 || got[2] != 3 {
+		t.Errorf("got %v, want [1 2 3]", got)
+	}
+	if err := <-errs; err == nil {
+		t.Error("expected an error after the connection closed")
+	}
+}
+
+func TestSendJSONBatch_AbortsOnTimeout(t *testing.T) {
+	stall := make(chan struct{})
+	url := newServer(t, func(conn *websocket.Conn) {
+		// Read the first message, then stop reading so writes back up.
+		conn.ReadMessage()
+		<-stall
+	})
+	t.Cleanup(func() { close(stall) })
+	p := newPool(t, url, Config{MaxConn: 1, WriteTimeout: 100 * time.Millisecond})
+
+	conn, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	defer conn.Release()
+
+	// The second message is large enough to fill the socket buffers.
+	big := strings.Repeat("x", 16<<20)
+	n, err := conn.SendJSONBatch([]any{"first", big, "third"})
+	if err == nil {
+		t.Fatal("expected a write timeout")
+	}
+	if n != 1 {
+		t.Errorf("sent = %d, want 1", n)
+	}
+	if !conn.broken.Load() {
+		t.Error("connection was not marked broken")
+	}
+}
+
+func TestLifetime_EvictsAtExpiry(t *testing.T) {
+	url := newEchoServer(t)
+	const lifetime = 50 * time.Millisecond
+	p := newPool(t, url, Config{MaxConn: 1, MaxConnLifetime: lifetime})
+
+	conn, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	conn.Release()
+	if got := idleCount(p); got != 1 {
+		t.Fatalf("idle = %d before expiry, want 1", got)
+	}
+
+	// The health check runs hourly, so only the expiry timer can evict it.
+	time.Sleep(2 * lifetime)
+	if got := idleCount(p); got != 0 {
+		t.Errorf("idle = %d after expiry, want 0", got)
+	}
+	if got := p.Stats().ActiveConns; got != 0 {
+		t.Errorf("ActiveConns = %d after expiry, want 0", got)
+	}
+}
+
+func TestStrictOwnership(t *testing.T) {
+	url := newEchoServer(t)
+	p := newPool(t, url, Config{MaxConn: 1, StrictOwnership: true})
+
+	conn, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+
+	errc := make(chan error, 1)
+	go func() { errc <- conn.SendMessage("from another goroutine") }()
+	if err := <-errc; !errors.Is(err, ErrNotOwner) {
+		t.Errorf("cross-goroutine send error = %v, want ErrNotOwner", err)
+	}
+
+	if err := conn.SendMessage("from owner"); err != nil {
+		t.Errorf("owner send: %v", err)
+	}
+	if _, err := conn.ReadMessage(); err != nil {
+		t.Errorf("owner read: %v", err)
+	}
+	conn.Release()
+
+	// After release, the next acquirer becomes the owner.
+	go func() {
+		c, err := p.Acquire(context.Background())
+		if err != nil {
+			errc <- err
+			return
+		}
+		defer c.Release()
+		errc <- c.SendMessage("new owner")
+	}()
+	if err := <-errc; err != nil {
+		t.Errorf("send by new owner: %v", err)
+	}
+}
+
+func TestResetStats(t *testing.T) {
+	url := newEchoServer(t)
+	p := newPool(t, url, Config{MinConn: 1, MaxConn: 1})
+
+	conn, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := p.Acquire(ctx); err == nil {
+		t.Fatal("expected error when pool is exhausted")
+	}
+	conn.Release()
+
+	before := p.Stats()
+	if before.DialCount != 1 || before.WaitCount != 1 {
+		t.Fatalf("stats before reset = %+v, want DialCount=1 WaitCount=1", before)
+	}
+
+	p.ResetStats()
+	after := p.Stats()
+	if after.DialCount != 0 || after.DialErrorCount != 0 || after.EvictCount != 0 || after.WaitCount != 0 {
+		t.Errorf("counters after reset = %+v, want zero", after)
+	}
+	if after.IdleConns != before.IdleConns || after.ActiveConns != before.ActiveConns || after.MaxConns != before.MaxConns {
+		t.Errorf("gauges changed by reset: before %+v, after %+v", before, after)
+	}
+}
+
+func TestSendMessage_DefaultMessageType(t *testing.T) {
+	types := make(chan int, 1)
+	url := newServer(t, func(conn *websocket.Conn) {
+		mt, _, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		types <- mt
+	})
+	p := newPool(t, url, Config{MaxConn: 1, DefaultMessageType: websocket.BinaryMessage})
+
+	conn, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	defer conn.Release()
+
+	if err := conn.SendMessage("payload"); err != nil {
+		t.Fatalf("SendMessage: %v", err)
+	}
+	if mt := <-types; mt != websocket.BinaryMessage {
+		t.Errorf("frame type = %d, want %d", mt, websocket.BinaryMessage)
+	}
+}
+
+func TestProbe(t *testing.T) {
+	var open sync.WaitGroup
+	url := newServer(t, func(conn *websocket.Conn) {
+		open.Add(1)
+		defer open.Done()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	})
+
+	t.Run("reachable", func(t *testing.T) {
+		if err := Probe(context.Background(), nil, url, nil); err != nil {
+			t.Fatalf("Probe: %v", err)
+		}
+		// The server handler returns once the probe connection is closed.
+		done := make(chan struct{})
+		go func() {
+			open.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Error("probe left its connection open")
+		}
+	})
+
+	t.Run("unreachable", func(t *testing.T) {
+		srv := httptest.NewServer(http.NotFoundHandler())
+		down := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+		srv.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if err := Probe(ctx, nil, down, nil); err == nil {
+			t.Fatal("expected error probing a down server")
+		}
+	})
+}
+
+func TestDrainOnSignal(t *testing.T) {
+	url := newEchoServer(t)
+	p := newPool(t, url, Config{MinConn: 2, MaxConn: 2})
+
+	stop := p.DrainOnSignal(os.Interrupt)
+	defer stop()
+
+	proc, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatalf("FindProcess: %v", err)
+	}
+	if err := proc.Signal(os.Interrupt); err != nil {
+		t.Skipf("sending signals is not supported: %v", err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for p.Stats().ActiveConns != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("pool not drained after signal: %+v", p.Stats())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if _, err := p.Acquire(context.Background()); err == nil {
+		t.Error("expected error acquiring from a drained pool")
+	}
+}
+
+func TestDebugSnapshot(t *testing.T) {
+	url := newEchoServer(t)
+	p := newPool(t, url, Config{MinConn: 2, MaxConn: 3})
+
+	if got := len(p.DebugSnapshot()); got != 2 {
+		t.Fatalf("snapshot has %d connections, want 2", got)
+	}
+
+	conn, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	if got := len(p.DebugSnapshot()); got != 1 {
+		t.Errorf("snapshot has %d connections while one is acquired, want 1", got)
+	}
+	conn.Release()
+
+	snap := p.DebugSnapshot()
+	if len(snap) != 2 {
+		t.Fatalf("snapshot has %d connections, want 2", len(snap))
+	}
+	var used int64
+	for _, info := range snap {
+		if info.URL != url {
+			t.Errorf("URL = %q, want %q", info.URL, url)
+		}
+		if info.RemoteAddr == "" {
+			t.Error("RemoteAddr is empty")
+		}
+		if info.Age <= 0 {
+			t.Errorf("Age = %v, want > 0", info.Age)
+		}
+		if info.Broken {
+			t.Error("healthy connection reported broken")
+		}
+		used += info.UsageCount
+	}
+	if used != 1 {
+		t.Errorf("total UsageCount = %d, want 1", used)
+	}
+}
+
+func TestMaxConnBytes_RetiresConnection(t *testing.T) {
+	url := newEchoServer(t)
+	evicted := make(chan EvictReason, 1)
+	p := newPool(t, url, Config{
+		MaxConn:      1,
+		MaxConnBytes: 10,
+		OnEvict:      func(conn *WsConn, reason EvictReason) { evicted <- reason },
+	})
+
+	conn, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	if err := conn.SendMessage("hello"); err != nil {
+		t.Fatalf("SendMessage: %v", err)
+	}
+	if conn.broken.Load() {
+		t.Fatal("connection retired below the byte limit")
+	}
+	if err := conn.SendMessage("world!"); err != nil {
+		t.Fatalf("SendMessage: %v", err)
+	}
+	conn.Release()
+
+	if conn.c != nil {
+		t.Error("connection past MaxConnBytes was not closed on release")
+	}
+	select {
+	case reason := <-evicted:
+		if reason != EvictExpired {
+			t.Errorf("OnEvict reason = %v, want %v", reason, EvictExpired)
+		}
+	case <-time.After(time.Second):
+		t.Error("OnEvict was not called")
+	}
+	if s := p.Stats(); s.IdleConns != 0 || s.ActiveConns != 0 {
+		t.Errorf("stats = %+v, want no connections", s)
+	}
+}
+
+func TestCancelRead(t *testing.T) {
+	url := newEchoServer(t)
+	p := newPool(t, url, Config{MaxConn: 1})
+
+	conn, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := conn.ReadMessage()
+		errc <- err
+	}()
+	time.Sleep(20 * time.Millisecond) // let the read block
+
+	if err := conn.CancelRead(); err != nil {
+		t.Fatalf("CancelRead: %v", err)
+	}
+	select {
+	case err := <-errc:
+		if !errors.Is(err, ErrReadCancelled) {
+			t.Errorf("read error = %v, want ErrReadCancelled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("CancelRead did not unblock the read")
+	}
+
+	// The socket is still open: sends keep working with the deadline cleared.
+	if err := conn.SendMessage("still here"); err != nil {
+		t.Errorf("SendMessage after CancelRead: %v", err)
+	}
+	conn.Release()
+	if s := p.Stats(); s.ActiveConns != 0 {
+		t.Errorf("ActiveConns = %d, want 0 after releasing a cancelled connection", s.ActiveConns)
+	}
+}
+
+func TestConnID(t *testing.T) {
+	url := newEchoServer(t)
+	p := newPool(t, url, Config{MaxConn: 2})
+
+	c1, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	c2, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	if c1.ID() == "" || c1.ID() == c2.ID() {
+		t.Fatalf("IDs %q and %q are not distinct", c1.ID(), c2.ID())
+	}
+	id := c2.ID()
+	c1.Release()
+	c2.Release()
+
+	// The most recently released connection is reused and keeps its ID.
+	c3, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	defer c3.Release()
+	if c3.pooledConn != c2.pooledConn || c3.ID() != id {
+		t.Errorf("ID after reuse = %q, want %q", c3.ID(), id)
+	}
+
+	var found bool
+	for _, info := range p.DebugSnapshot() {
+		found = found || info.ID == c1.ID()
+	}
+	if !found {
+		t.Errorf("DebugSnapshot does not list idle connection %q", c1.ID())
+	}
+}
+
+func TestAcquireN(t *testing.T) {
+	url := newEchoServer(t)
+	const max = 3
+
+	t.Run("all", func(t *testing.T) {
+		p := newPool(t, url, Config{MaxConn: max})
+		conns, err := p.AcquireN(context.Background(), max)
+		if err != nil {
+			t.Fatalf("AcquireN: %v", err)
+		}
+		if len(conns) != max {
+			t.Fatalf("got %d connections, want %d", len(conns), max)
+		}
+		seen := make(map[*WsConn]bool)
+		for _, c := range conns {
+			if seen[c] {
+				t.Error("AcquireN returned the same connection twice")
+			}
+			seen[c] = true
+			c.Release()
+		}
+	})
+
+	t.Run("none on failure", func(t *testing.T) {
+		p := newPool(t, url, Config{MaxConn: max})
+		held, err := p.Acquire(context.Background())
+		if err != nil {
+			t.Fatalf("Acquire: %v", err)
+		}
+		defer held.Release()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		if _, err := p.AcquireN(ctx, max); err == nil {
+			t.Fatal("expected error when the batch cannot be satisfied")
+		}
+		if got := idleCount(p); got != max-1 {
+			t.Errorf("idle = %d after failed batch, want %d", got, max-1)
+		}
+	})
+
+	t.Run("invalid n", func(t *testing.T) {
+		p := newPool(t, url, Config{MaxConn: max})
+		if _, err := p.AcquireN(context.Background(), max+1); err == nil {
+			t.Error("expected error for n > MaxConn")
+		}
+	})
+}
+
+func TestErrorClassifier_RetriableReconnects(t *testing.T) {
+	var dials atomic.Int32
+	url := newServer(t, func(conn *websocket.Conn) {
+		if dials.Add(1) == 1 {
+			// The first connection is shut down by the server.
+			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(4000, "restart"))
+			return
+		}
+		conn.WriteMessage(websocket.TextMessage, []byte("hello"))
+		conn.ReadMessage()
+	})
+	classifier := func(err error) ErrorKind {
+		if websocket.IsCloseError(err, 4000) {
+			return ErrorRetriable
+		}
+		return DefaultErrorClassifier(err)
+	}
+	p := newPool(t, url, Config{MaxConn: 1, ErrorClassifier: classifier})
+
+	conn, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	defer conn.Release()
+
+	got, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %v", err)
+	}
+	if string(got) != "hello" {
+		t.Errorf("got %q, want %q", got, "hello")
+	}
+	if n := dials.Load(); n != 2 {
+		t.Errorf("server saw %d connections, want 2", n)
+	}
+	if conn.broken.Load() {
+		t.Error("reconnected connection is marked broken")
+	}
+}
+
+func TestDefaultErrorClassifier(t *testing.T) {
+	cases := []struct {
+		err  error
+		want ErrorKind
+	}{
+		{&websocket.CloseError{Code: websocket.CloseGoingAway}, ErrorBroken},
+		{io.ErrUnexpectedEOF, ErrorBroken},
+		{ErrReadCancelled, ErrorBroken},
+		{errors.New("application error"), ErrorSurface},
+	}
+	for _, tc := range cases {
+		if got := DefaultErrorClassifier(tc.err); got != tc.want {
+			t.Errorf("DefaultErrorClassifier(%v) = %d, want %d", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestHealthCheck_PauseResume(t *testing.T) {
+	url := newEchoServer(t)
+	const period = 50 * time.Millisecond
+	p := newPool(t, url, Config{
+		MaxConn:           1,
+		MaxConnIdleTime:   10 * time.Millisecond,
+		HealthCheckPeriod: period,
+	})
+
+	conn, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	p.PauseHealthCheck()
+	conn.Release()
+
+	time.Sleep(4 * period)
+	if got := idleCount(p); got != 1 {
+		t.Fatalf("idle = %d while paused, want 1", got)
+	}
+
+	p.ResumeHealthCheck()
+	deadline := time.Now().Add(period / 2)
+	for idleCount(p) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("idle connection not evicted right after resume")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestClose_ReturnsConnectionErrors(t *testing.T) {
+	url := newEchoServer(t)
+	p := newPool(t, url, Config{MinConn: 2, MaxConn: 2})
+
+	// Break one idle connection underneath the pool so that closing it fails.
+	p.lock.Lock()
+	p.idleConns()[0].c.NetConn().Close()
+	p.lock.Unlock()
+
+	if err := p.Close(); err == nil {
+		t.Fatal("expected an error from a connection that failed to close")
+	}
+	if err := p.Close(); err != nil {
+		t.Errorf("second Close = %v, want nil", err)
+	}
+}
+
+func TestSendMessageN(t *testing.T) {
+	url := newEchoServer(t)
+	p := newPool(t, url, Config{MaxConn: 1})
+
+	conn, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	defer conn.Release()
+
+	const msg = "héllo"
+	n, err := conn.SendMessageN(msg)
+	if err != nil {
+		t.Fatalf("SendMessageN: %v", err)
+	}
+	if n != len(msg) {
+		t.Errorf("n = %d, want %d", n, len(msg))
+	}
+}
+
+func TestReadWithIdleTimeout(t *testing.T) {
+	const (
+		interval = 20 * time.Millisecond
+		count    = 6
+		idle     = 5 * interval
+	)
+	url := newServer(t, func(conn *websocket.Conn) {
+		for i := 0; i < count; i++ {
+			time.Sleep(interval)
+			if err := conn.WriteMessage(websocket.TextMessage, []byte("tick")); err != nil {
+				return
+			}
+		}
+		conn.ReadMessage() // stay open but silent
+	})
+	p := newPool(t, url, Config{MaxConn: 1})
+
+	conn, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	defer conn.Release()
+
+	// The stream as a whole outlasts idle, but every gap is shorter.
+	for i := 0; i < count; i++ {
+		if _, err := conn.ReadWithIdleTimeout(idle); err != nil {
+			t.Fatalf("read #%d: %v", i+1, err)
+		}
+	}
+
+	var netErr net.Error
+	if _, err := conn.ReadWithIdleTimeout(idle); !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("read after stream went quiet = %v, want timeout", err)
+	}
+}
+
+func TestMaxConcurrentOps(t *testing.T) {
+	url := newEchoServer(t)
+	p := newPool(t, url, Config{MaxConn: 2, MaxConcurrentOps: 1})
+
+	conns, err := p.AcquireN(context.Background(), 2)
+	if err != nil {
+		t.Fatalf("AcquireN: %v", err)
+	}
+	defer conns[0].Release()
+	defer conns[1].Release()
+
+	// Occupy the only slot as if a send were in flight on the first connection.
+	p.ops <- struct{}{}
+
+	done := make(chan error, 1)
+	go func() { done <- conns[1].SendMessage("queued") }()
+
+	select {
+	case <-done:
+		t.Fatal("send did not block while MaxConcurrentOps was reached")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	<-p.ops
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("SendMessage: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("send still blocked after the slot was freed")
+	}
+}
+
+func TestOnConnError(t *testing.T) {
+	url := newServer(t, func(conn *websocket.Conn) {
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "bye"))
+	})
+	type report struct {
+		conn *WsConn
+		err  error
+	}
+	reports := make(chan report, 2)
+	p := newPool(t, url, Config{
+		MaxConn:     1,
+		OnConnError: func(conn *WsConn, err error) { reports <- report{conn, err} },
+	})
+
+	conn, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	defer conn.Release()
+
+	_, readErr := conn.ReadMessage()
+	if readErr == nil {
+		t.Fatal("expected a read error")
+	}
+	conn.ReadMessage() // already broken; must not report again
+
+	select {
+	case r := <-reports:
+		if r.conn != conn || r.conn.ID() != conn.ID() {
+			t.Error("callback received the wrong connection")
+		}
+		if r.err != readErr {
+			t.Errorf("callback error = %v, want %v", r.err, readErr)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnConnError was not called")
+	}
+	select {
+	case r := <-reports:
+		t.Errorf("OnConnError called twice, second error: %v", r.err)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSendJSONDedup(t *testing.T) {
+	received := make(chan string, 4)
+	url := newServer(t, func(conn *websocket.Conn) {
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			received <- string(msg)
+		}
+	})
+	p := newPool(t, url, Config{MaxConn: 1, DedupWindow: time.Minute})
+
+	conn, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	defer conn.Release()
+
+	for i, wantSent := range []bool{true, false} {
+		sent, err := conn.SendJSONDedup("order-1", map[string]int{"attempt": i})
+		if err != nil {
+			t.Fatalf("SendJSONDedup #%d: %v", i+1, err)
+		}
+		if sent != wantSent {
+			t.Errorf("SendJSONDedup #%d sent = %v, want %v", i+1, sent, wantSent)
+		}
+	}
+	if _, err := conn.SendJSONDedup("order-2", "other"); err != nil {
+		t.Fatalf("SendJSONDedup: %v", err)
+	}
+
+	want := []string{`{"attempt":0}`, `"other"`}
+	for _, w := range want {
+		select {
+		case got := <-received:
+			if got != w {
+				t.Errorf("server received %s, want %s", got, w)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("server did not receive %s", w)
+		}
+	}
+	select {
+	case got := <-received:
+		t.Errorf("unexpected extra message %s", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSendJSONDedup_SharedAcrossRoles(t *testing.T) {
+	url := newEchoServer(t)
+	p := newPool(t, url, Config{MaxConn: 1, MaxReaders: 1, MaxWriters: 1})
+
+	for i, acquire := range []func(context.Context) (*WsConn, error){p.Acquire, p.AcquireReader, p.AcquireWriter} {
+		conn, err := acquire(context.Background())
+		if err != nil {
+			t.Fatalf("acquire: %v", err)
+		}
+		defer conn.Release()
+		sent, err := conn.SendJSONDedup("order-1", i)
+		if err != nil {
+			t.Fatalf("SendJSONDedup: %v", err)
+		}
+		if want := i == 0; sent != want {
+			t.Errorf("SendJSONDedup on role %d sent = %v, want %v", i, sent, want)
+		}
+	}
+}
+
+func TestDedupClaim_PrunesExpiredKeys(t *testing.T) {
+	url := newEchoServer(t)
+	p := newPool(t, url, Config{MaxConn: 1, DedupWindow: 20 * time.Millisecond})
+
+	for _, key := range []string{"a", "b"} {
+		if !p.dedupClaim(key) {
+			t.Fatalf("dedupClaim(%q) = false on first claim", key)
+		}
+	}
+	p.dedupForget("b")
+	if !p.dedupClaim("b") {
+		t.Fatal("dedupClaim after dedupForget = false, want true")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if !p.dedupClaim("a") {
+		t.Error("dedupClaim of an expired key = false, want true")
+	}
+	if len(p.dedup) != 1 || len(p.dedupOrder) != 1 {
+		t.Errorf("%d keys and %d entries left, want only the new claim", len(p.dedup), len(p.dedupOrder))
+	}
+}
+
+func TestSaturationPolicy(t *testing.T) {
+	url := newEchoServer(t)
+
+	// saturate returns a pool whose only connection is held by the test.
+	saturate := func(t *testing.T, cfg Config) *Pool {
+		cfg.MaxConn = 1
+		p := newPool(t, url, cfg)
+		conn, err := p.Acquire(context.Background())
+		if err != nil {
+			t.Fatalf("Acquire: %v", err)
+		}
+		t.Cleanup(conn.Release)
+		return p
+	}
+
+	t.Run("block", func(t *testing.T) {
+		p := saturate(t, Config{SaturationPolicy: SaturationBlock})
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+		defer cancel()
+		if _, err := p.Acquire(ctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("err = %v, want context.DeadlineExceeded", err)
+		}
+	})
+
+	t.Run("error", func(t *testing.T) {
+		p := saturate(t, Config{SaturationPolicy: SaturationError})
+		if _, err := p.Acquire(context.Background()); !errors.Is(err, ErrPoolExhausted) {
+			t.Errorf("err = %v, want ErrPoolExhausted", err)
+		}
+	})
+
+	t.Run("shed", func(t *testing.T) {
+		var shed int
+		p := saturate(t, Config{SaturationPolicy: SaturationShed, OnShed: func() { shed++ }})
+		if _, err := p.Acquire(context.Background()); !errors.Is(err, ErrShed) {
+			t.Errorf("err = %v, want ErrShed", err)
+		}
+		if shed != 1 {
+			t.Errorf("OnShed called %d times, want 1", shed)
+		}
+	})
+}
+
+func TestControlStats(t *testing.T) {
+	url := newServer(t, func(conn *websocket.Conn) {
+		deadline := time.Now().Add(time.Second)
+		conn.WriteControl(websocket.PingMessage, nil, deadline)
+		conn.WriteControl(websocket.PingMessage, nil, deadline)
+		conn.WriteMessage(websocket.TextMessage, []byte("after pings"))
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), deadline)
+		conn.ReadMessage()
+	})
+	p := newPool(t, url, Config{MaxConn: 1})
+
+	conn, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	defer conn.Release()
+
+	if _, err := conn.ReadMessage(); err != nil {
+		t.Fatalf("ReadMessage: %v", err)
+	}
+	if got := conn.ControlStats().Pings; got != 2 {
+		t.Errorf("Pings = %d, want 2", got)
+	}
+
+	if _, err := conn.ReadMessage(); err == nil {
+		t.Fatal("expected close error")
+	}
+	if got := conn.ControlStats().Closes; got != 1 {
+		t.Errorf("Closes = %d, want 1", got)
+	}
+}
+
+func TestRelease_StaleLeaseIgnored(t *testing.T) {
+	url := newEchoServer(t)
+	p := newPool(t, url, Config{MaxConn: 1})
+
+	conn, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	stale := conn.Lease()
+	conn.Release()
+	conn.Release() // double release must not pool the connection twice
+	if got := idleCount(p); got != 1 {
+		t.Fatalf("idle = %d after double Release, want 1", got)
+	}
+
+	again, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	if again.pooledConn != conn.pooledConn || again.Lease() == stale {
+		t.Fatalf("re-acquire: same conn %v, lease %d (stale %d)", again.pooledConn == conn.pooledConn, again.Lease(), stale)
+	}
+
+	// The old holder's release must not take the connection from the new one.
+	conn.ReleaseLease(stale)
+	if got := idleCount(p); got != 0 {
+		t.Errorf("idle = %d after stale release, want 0", got)
+	}
+	again.Release()
+	if got := idleCount(p); got != 1 {
+		t.Errorf("idle = %d after current release, want 1", got)
+	}
+}
+
+func TestRelease_StaleHandleIgnored(t *testing.T) {
+	url := newEchoServer(t)
+	p := newPool(t, url, Config{MaxConn: 1})
+
+	conn, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	conn.Release()
+	again, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	if again.pooledConn != conn.pooledConn {
+		t.Fatal("re-acquire dialed a new connection")
+	}
+	current := again.Lease()
+
+	// The old holder's plain Release must not end the new acquisition.
+	conn.Release()
+	if got := again.Lease(); got != current {
+		t.Errorf("Lease = %d after stale Release, want %d", got, current)
+	}
+	if stats := p.Stats(); stats.IdleConns != 0 || stats.ActiveConns != 1 {
+		t.Errorf("stats = %+v after stale Release, want the connection still acquired", stats)
+	}
+
+	again.Release()
+	if got := idleCount(p); got != 1 {
+		t.Errorf("idle = %d after current release, want 1", got)
+	}
+}
+
+func TestInterceptors(t *testing.T) {
+	received := make(chan string, 1)
+	url := newServer(t, func(conn *websocket.Conn) {
+		mt, msg, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		received <- string(msg)
+		conn.WriteMessage(mt, msg)
+		conn.ReadMessage()
+	})
+
+	type login struct {
+		User     string `json:"user"`
+		Password string `json:"password"`
+	}
+	redact := func(_ int, data []byte) ([]byte, error) {
+		var l login
+		if err := json.Unmarshal(data, &l); err != nil {
+			return nil, err
+		}
+		l.Password = "[redacted]"
+		return json.Marshal(l)
+	}
+	var inbound int
+	count := func(_ int, data []byte) ([]byte, error) {
+		inbound++
+		return data, nil
+	}
+	p := newPool(t, url, Config{MaxConn: 1, SendInterceptor: redact, ReceiveInterceptor: count})
+
+	conn, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	defer conn.Release()
+
+	if err := conn.SendJSON(login{User: "alice", Password: "hunter2"}); err != nil {
+		t.Fatalf("SendJSON: %v", err)
+	}
+	if got, want := <-received, `{"user":"alice","password":"[redacted]"}`; got != want {
+		t.Errorf("server received %s, want %s", got, want)
+	}
+
+	var echo login
+	if err := conn.ReadJSON(&echo); err != nil {
+		t.Fatalf("ReadJSON: %v", err)
+	}
+	if inbound != 1 {
+		t.Errorf("ReceiveInterceptor called %d times, want 1", inbound)
+	}
+	if echo.Password != "[redacted]" {
+		t.Errorf("echoed password = %q, want redacted", echo.Password)
+	}
+
+	// An interceptor error aborts the send.
+	if err := conn.SendMessage("not json"); err == nil {
+		t.Error("expected the SendInterceptor error to abort the send")
+	}
+}
+
+func TestMessageValidator(t *testing.T) {
+	url := newEchoServer(t)
+	errMissingID := errors.New("missing id")
+	validate := func(data []byte) error {
+		var msg struct {
+			ID *int `json:"id"`
+		}
+		if err := json.Unmarshal(data, &msg); err != nil || msg.ID == nil {
+			return errMissingID
+		}
+		return nil
+	}
+
+	t.Run("rejects", func(t *testing.T) {
+		p := newPool(t, url, Config{MaxConn: 1, MessageValidator: validate})
+		conn, err := p.Acquire(context.Background())
+		if err != nil {
+			t.Fatalf("Acquire: %v", err)
+		}
+		defer conn.Release()
+
+		if err := conn.SendMessage(`{"id":1}`); err != nil {
+			t.Fatalf("SendMessage: %v", err)
+		}
+		if _, err := conn.ReadMessage(); err != nil {
+			t.Fatalf("valid message rejected: %v", err)
+		}
+		if err := conn.SendMessage(`{"name":"x"}`); err != nil {
+			t.Fatalf("SendMessage: %v", err)
+		}
+		var v map[string]any
+		if err := conn.ReadJSON(&v); !errors.Is(err, errMissingID) {
+			t.Errorf("ReadJSON error = %v, want errMissingID", err)
+		}
+		if conn.broken.Load() {
+			t.Error("validation error broke the connection under the default classifier")
+		}
+	})
+
+	t.Run("breaks when classified", func(t *testing.T) {
+		classify := func(err error) ErrorKind {
+			if errors.Is(err, errMissingID) {
+				return ErrorBroken
+			}
+			return DefaultErrorClassifier(err)
+		}
+		p := newPool(t, url, Config{MaxConn: 1, MessageValidator: validate, ErrorClassifier: classify})
+		conn, err := p.Acquire(context.Background())
+		if err != nil {
+			t.Fatalf("Acquire: %v", err)
+		}
+		defer conn.Release()
+
+		if err := conn.SendMessage(`{}`); err != nil {
+			t.Fatalf("SendMessage: %v", err)
+		}
+		if _, err := conn.ReadMessage(); !errors.Is(err, errMissingID) {
+			t.Errorf("ReadMessage error = %v, want errMissingID", err)
+		}
+		if !conn.broken.Load() {
+			t.Error("connection not marked broken")
+		}
+	})
+}
+
+func TestHealthCheck_AdaptivePeriod(t *testing.T) {
+	url := newEchoServer(t)
+	const base = 10 * time.Millisecond
+	p := newPool(t, url, Config{
+		MaxConn:              1,
+		HealthCheckPeriod:    base,
+		AdaptiveHealthCheck:  true,
+		MaxHealthCheckPeriod: 4 * base,
+	})
+
+	waitForPeriod := func(want time.Duration) {
+		t.Helper()
+		deadline := time.Now().Add(time.Second)
+		for p.Stats().HealthCheckPeriod != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("HealthCheckPeriod = %v, want %v", p.Stats().HealthCheckPeriod, want)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// Quiet pool: the period backs off to the cap.
+	waitForPeriod(4 * base)
+
+	// Activity: the next check resets it.
+	conn, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	conn.Release()
+	waitForPeriod(base)
+}
+
+func TestAcquireWithBudget(t *testing.T) {
+	url := newEchoServer(t)
+	p := newPool(t, url, Config{MaxConn: 1})
+
+	held, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	const wait = 100 * time.Millisecond
+	go func() {
+		time.Sleep(wait)
+		held.Release()
+	}()
+
+	const timeout = 500 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	conn, budget, err := p.AcquireWithBudget(ctx)
+	if err != nil {
+		t.Fatalf("AcquireWithBudget: %v", err)
+	}
+	defer conn.Release()
+
+	if budget <= 0 || budget > timeout-wait {
+		t.Errorf("budget = %v, want in (0, %v]", budget, timeout-wait)
+	}
+}
+
+func TestSendAny_SkipsDeadConnection(t *testing.T) {
+	received := make(chan string, 3)
+	url := newServer(t, func(conn *websocket.Conn) {
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			received <- string(msg)
+		}
+	})
+	p := newPool(t, url, Config{MaxConn: 3})
+
+	conns, err := p.AcquireN(context.Background(), 3)
+	if err != nil {
+		t.Fatalf("AcquireN: %v", err)
+	}
+	dead := conns[0]
+	dead.c.NetConn().Close()
+	for _, c := range conns {
+		c.Release()
+	}
+
+	if err := p.SendAny(context.Background(), websocket.TextMessage, []byte("hi")); err != nil {
+		t.Fatalf("SendAny: %v", err)
+	}
+	select {
+	case msg := <-received:
+		if msg != "hi" {
+			t.Errorf("server received %q, want %q", msg, "hi")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no healthy connection delivered the message")
+	}
+
+	// Every send finishes and returns its connection; the dead one is evicted.
+	deadline := time.Now().Add(time.Second)
+	for p.Stats().ActiveConns != 2 || idleCount(p) != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("stats = %+v, want the dead connection evicted", p.Stats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if dead.c != nil {
+		t.Error("dead connection was not closed")
+	}
+}
+
+func TestMinIdleConn(t *testing.T) {
+	url := newEchoServer(t)
+	p := newPool(t, url, Config{
+		MinConn:           0,
+		MinIdleConn:       2,
+		MaxConn:           3,
+		HealthCheckPeriod: 10 * time.Millisecond,
+	})
+
+	if got := idleCount(p); got != 0 {
+		t.Fatalf("idle = %d at startup, want MinConn = 0", got)
+	}
+
+	// The health check warms up the idle reserve.
+	deadline := time.Now().Add(time.Second)
+	for idleCount(p) != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("idle = %d, want MinIdleConn = 2", idleCount(p))
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Taking connections out is topped up on release, within MaxConn.
+	c1, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	c2, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	c1.Release()
+	if got := idleCount(p); got != 2 {
+		t.Errorf("idle = %d after release, want 2", got)
+	}
+	if got := p.Stats().ActiveConns; got != 3 {
+		t.Errorf("ActiveConns = %d, want MaxConn = 3", got)
+	}
+	c2.Release()
+}
+
+func TestCoalesceWindow(t *testing.T) {
+	frames := make(chan string, 4)
+	url := newServer(t, func(conn *websocket.Conn) {
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			frames <- string(msg)
+		}
+	})
+	p := newPool(t, url, Config{MaxConn: 1, CoalesceWindow: 20 * time.Millisecond})
+
+	conn, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	for _, msg := range []string{"a", "b", "c"} {
+		if err := conn.SendMessage(msg); err != nil {
+			t.Fatalf("SendMessage: %v", err)
+		}
+	}
+	select {
+	case got := <-frames:
+		if got != "a\nb\nc" {
+			t.Errorf("frame = %q, want %q", got, "a\nb\nc")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("coalesced frame was not flushed")
+	}
+
+	// Release flushes whatever is still buffered. A buffered message has not
+	// been written yet.
+	if n, err := conn.SendMessageN("d"); err != nil || n != 0 {
+		t.Fatalf("SendMessageN = %d, %v; want 0, nil", n, err)
+	}
+	conn.Release()
+	select {
+	case got := <-frames:
+		if got != "d" {
+			t.Errorf("frame = %q, want %q", got, "d")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("buffered message was not flushed on release")
+	}
+	select {
+	case got := <-frames:
+		t.Errorf("unexpected extra frame %q", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestCoalesceWindow_FlushedBeforeRead(t *testing.T) {
+	url := newEchoServer(t)
+	p := newPool(t, url, Config{MaxConn: 1, CoalesceWindow: time.Hour, ReadTimeout: time.Second})
+
+	conn, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	defer conn.Release()
+	if err := conn.SendMessage("ping"); err != nil {
+		t.Fatalf("SendMessage: %v", err)
+	}
+	got, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %v", err)
+	}
+	if string(got) != "ping" {
+		t.Errorf("ReadMessage = %q, want %q", got, "ping")
+	}
+}
+
+func TestSetReadOnly(t *testing.T) {
+	url := newServer(t, func(conn *websocket.Conn) {
+		conn.WriteMessage(websocket.TextMessage, []byte("push"))
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	})
+	p := newPool(t, url, Config{MaxConn: 1})
+
+	conn, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	conn.SetReadOnly(true)
+	if err := conn.SendMessage("x"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("SendMessage error = %v, want ErrReadOnly", err)
+	}
+	if err := conn.SendJSON(map[string]int{"a": 1}); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("SendJSON error = %v, want ErrReadOnly", err)
+	}
+	msg, err := conn.ReadMessage()
+	if err != nil || string(msg) != "push" {
+		t.Fatalf("ReadMessage = %q, %v; want %q", msg, err, "push")
+	}
+	conn.Release()
+
+	conn, err = p.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	defer conn.Release()
+	if err := conn.SendMessage("x"); err != nil {
+		t.Errorf("SendMessage after release: %v", err)
+	}
+}
+
+func TestOnNewConn_RetriesOnSameConnection(t *testing.T) {
+	url := newEchoServer(t)
+	var calls int
+	var seen []*WsConn
+	p := newPool(t, url, Config{
+		MaxConn:          1,
+		OnNewConnRetries: 2,
+		OnNewConn: func(conn *WsConn) error {
+			calls++
+			seen = append(seen, conn)
+			if calls == 1 {
+				return errors.New("auth hiccup")
+			}
+			return conn.SendMessage("auth")
+		},
+	})
+
+	conn, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	defer conn.Release()
+
+	if calls != 2 {
+		t.Errorf("OnNewConn called %d times, want 2", calls)
+	}
+	for _, c := range seen {
+		if c.pooledConn != conn.pooledConn {
+			t.Error("OnNewConn retry used a different connection")
+		}
+	}
+	if got := p.Stats().DialCount; got != 1 {
+		t.Errorf("DialCount = %d, want 1", got)
+	}
+	msg, err := conn.ReadMessage()
+	if err != nil || string(msg) != "auth" {
+		t.Errorf("ReadMessage = %q, %v; want the handshake echo", msg, err)
+	}
+}
+
+func TestOnNewConn_FailureDiscardsConnection(t *testing.T) {
+	url := newEchoServer(t)
+	p := newPool(t, url, Config{
+		MaxConn:          1,
+		OnNewConnRetries: 1,
+		OnNewConn:        func(*WsConn) error { return errors.New("rejected") },
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := p.Acquire(ctx); err == nil {
+		t.Fatal("Acquire succeeded despite a failing OnNewConn")
+	}
+	if stats := p.Stats(); stats.ActiveConns != 0 {
+		t.Errorf("ActiveConns = %d, want 0", stats.ActiveConns)
+	}
+}
+
+func TestOnMaxConnReached(t *testing.T) {
+	url := newEchoServer(t)
+	reached := make(chan struct{}, 4)
+	p := newPool(t, url, Config{
+		MaxConn:          2,
+		SaturationPolicy: SaturationError,
+		OnMaxConnReached: func() { reached <- struct{}{} },
+	})
+	expect := func(want int) {
+		t.Helper()
+		got := 0
+		timeout := time.After(100 * time.Millisecond)
+		for {
+			select {
+			case <-reached:
+				got++
+			case <-timeout:
+				if got != want {
+					t.Errorf("OnMaxConnReached fired %d times, want %d", got, want)
+				}
+				return
+			}
+		}
+	}
+
+	a, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	b, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	if _, err := p.Acquire(context.Background()); !errors.Is(err, ErrPoolExhausted) {
+		t.Fatalf("Acquire at capacity error = %v, want ErrPoolExhausted", err)
+	}
+	expect(1)
+
+	// Drop below MaxConn, then saturate again.
+	p.Invalidate(a)
+	a.Release()
+	a, err = p.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	expect(1)
+	a.Release()
+	b.Release()
+}
+
+func TestExpiryPolicy(t *testing.T) {
+	const lifetime = 50 * time.Millisecond
+	url := newEchoServer(t)
+
+	t.Run("on release", func(t *testing.T) {
+		p := newPool(t, url, Config{MaxConn: 1, MaxConnLifetime: lifetime})
+		conn, err := p.Acquire(context.Background())
+		if err != nil {
+			t.Fatalf("Acquire: %v", err)
+		}
+		time.Sleep(2 * lifetime)
+		if err := conn.SendMessage("still usable"); err != nil {
+			t.Errorf("SendMessage after expiry: %v", err)
+		}
+		conn.Release()
+		if got := idleCount(p); got != 0 {
+			t.Errorf("idle = %d after release, want 0", got)
+		}
+		if stats := p.Stats(); stats.ActiveConns != 0 || stats.EvictCount != 1 {
+			t.Errorf("stats = %+v, want the expired connection evicted", stats)
+		}
+	})
+
+	t.Run("immediately", func(t *testing.T) {
+		p := newPool(t, url, Config{MaxConn: 1, MaxConnLifetime: lifetime, ExpiryPolicy: ExpireImmediately})
+		conn, err := p.Acquire(context.Background())
+		if err != nil {
+			t.Fatalf("Acquire: %v", err)
+		}
+		time.Sleep(2 * lifetime)
+		if err := conn.SendMessage("too late"); err == nil {
+			t.Error("SendMessage succeeded on a connection closed at expiry")
+		}
+		conn.Release()
+		if got := p.Stats().ActiveConns; got != 0 {
+			t.Errorf("ActiveConns = %d after release, want 0", got)
+		}
+	})
+}
+
+func TestURLWeights(t *testing.T) {
+	heavy, light := newEchoServer(t), newEchoServer(t)
+	p, err := New(Config{
+		Dialer:            websocket.DefaultDialer,
+		URLs:              []string{heavy, light},
+		URLWeights:        []int{3, 1},
+		MaxConn:           40,
+		HealthCheckPeriod: time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	t.Cleanup(func() { p.Close() })
+
+	conns, err := p.AcquireN(context.Background(), 40)
+	if err != nil {
+		t.Fatalf("AcquireN: %v", err)
+	}
+	counts := make(map[string]int)
+	for _, conn := range conns {
+		counts[conn.URL()]++
+		conn.Release()
+	}
+	if counts[heavy] != 30 || counts[light] != 10 {
+		t.Errorf("connections per URL = %d:%d, want 30:10", counts[heavy], counts[light])
+	}
+}
+
+func TestLastError(t *testing.T) {
+	url := newEchoServer(t)
+	p := newPool(t, url, Config{MaxConn: 1})
+
+	conn, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	defer conn.Release()
+	if err := conn.SendMessage("ok"); err != nil {
+		t.Fatalf("SendMessage: %v", err)
+	}
+	if err := conn.LastError(); err != nil {
+		t.Errorf("LastError after success = %v, want nil", err)
+	}
+
+	conn.c.NetConn().Close()
+	sendErr := conn.SendMessage("fails")
+	if sendErr == nil {
+		t.Fatal("SendMessage succeeded on a closed socket")
+	}
+	if err := conn.LastError(); err != sendErr {
+		t.Errorf("LastError = %v, want %v", err, sendErr)
+	}
+}
+
+func TestTryAcquire(t *testing.T) {
+	url := newEchoServer(t)
+	p := newPool(t, url, Config{MaxConn: 1})
+
+	conn, ok := p.TryAcquire()
+	if !ok {
+		t.Fatal("TryAcquire failed on an empty pool")
+	}
+	if _, ok := p.TryAcquire(); ok {
+		t.Fatal("TryAcquire succeeded on a saturated pool")
+	}
+	if got := p.Stats().WaitCount; got != 0 {
+		t.Errorf("WaitCount = %d, want 0", got)
+	}
+	conn.Release()
+
+	conn, ok = p.TryAcquire()
+	if !ok {
+		t.Fatal("TryAcquire failed with an idle connection")
+	}
+	conn.Release()
+}
+
+func TestOnPanic_PoolSurvives(t *testing.T) {
+	url := newEchoServer(t)
+	panics := make(chan any, 1)
+	p := newPool(t, url, Config{
+		MaxConn:          1,
+		OnMaxConnReached: func() { panic("hook failed") },
+		OnPanic:          func(v any) { panics <- v },
+	})
+
+	conn, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	select {
+	case v := <-panics:
+		if v != "hook failed" {
+			t.Errorf("OnPanic value = %v, want %q", v, "hook failed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("panic was not reported")
+	}
+
+	if err := conn.SendMessage("still alive"); err != nil {
+		t.Errorf("SendMessage after panic: %v", err)
+	}
+	conn.Release()
+	if _, err := p.Acquire(context.Background()); err != nil {
+		t.Errorf("Acquire after panic: %v", err)
+	}
+}
+
+func TestHandshakeHeaders(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, http.Header{"X-Session-Id": {"abc123"}})
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	p := newPool(t, "ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", Config{MaxConn: 1})
+
+	conn, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	defer conn.Release()
+	if got := conn.HandshakeHeaders().Get("X-Session-Id"); got != "abc123" {
+		t.Errorf("X-Session-Id = %q, want %q", got, "abc123")
+	}
+}
+
+func TestLifetimeStagger(t *testing.T) {
+	url := newEchoServer(t)
+	const lifetime, stagger = 50 * time.Millisecond, 100 * time.Millisecond
+	p := newPool(t, url, Config{
+		MinConn:         4,
+		MaxConn:         4,
+		MaxConnLifetime: lifetime,
+		LifetimeStagger: stagger,
+	})
+
+	// The four connections expire together but are retired one per stagger
+	// interval, at roughly 50ms, 150ms, 250ms and 350ms.
+	time.Sleep(lifetime + stagger/2)
+	if got := p.Stats().EvictCount; got != 1 {
+		t.Errorf("EvictCount = %d shortly after expiry, want 1", got)
+	}
+	if got := idleCount(p); got != 3 {
+		t.Errorf("idle = %d shortly after expiry, want 3 still serving", got)
+	}
+
+	time.Sleep(4 * stagger)
+	if got := p.Stats().EvictCount; got != 4 {
+		t.Errorf("EvictCount = %d after all slots passed, want 4", got)
+	}
+}
+
+func TestShouldPoolOnRelease(t *testing.T) {
+	url := newEchoServer(t)
+	p := newPool(t, url, Config{
+		MaxConn:             1,
+		ShouldPoolOnRelease: func(conn *WsConn) bool { return conn.UsageCount() < 3 },
+	})
+
+	var first *WsConn
+	for i := 0; i < 3; i++ {
+		conn, err := p.Acquire(context.Background())
+		if err != nil {
+			t.Fatalf("Acquire: %v", err)
+		}
+		if first == nil {
+			first = conn
+		} else if conn.pooledConn != first.pooledConn {
+			t.Fatalf("acquire %d got a new connection before the threshold", i+1)
+		}
+		conn.Release()
+	}
+
+	// The third release reached the threshold and closed the connection.
+	if got := idleCount(p); got != 0 {
+		t.Errorf("idle = %d, want 0", got)
+	}
+	conn, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	defer conn.Release()
+	if conn.pooledConn == first.pooledConn || conn.UsageCount() != 1 {
+		t.Errorf("got a connection with UsageCount %d, want a fresh one", conn.UsageCount())
+	}
+}
+
+func TestReadAny(t *testing.T) {
+	var accepted atomic.Int32
+	url := newServer(t, func(conn *websocket.Conn) {
+		if accepted.Add(1) == 2 {
+			time.Sleep(20 * time.Millisecond)
+			conn.WriteMessage(websocket.TextMessage, []byte("hello"))
+		}
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	})
+	p := newPool(t, url, Config{MinConn: 2, MaxConn: 2})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	data, conn, err := p.ReadAny(ctx)
+	if err != nil {
+		t.Fatalf("ReadAny: %v", err)
+	}
+	if string(data) != "hello" {
+		t.Errorf("ReadAny = %q, want %q", data, "hello")
+	}
+	if conn.ID() != "2" {
+		t.Errorf("message attributed to connection %s, want 2", conn.ID())
+	}
+
+	// Nothing else arrives; the readers keep waiting until ctx ends.
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, _, err := p.ReadAny(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("second ReadAny error = %v, want DeadlineExceeded", err)
+	}
+}
+
+func TestReadMessage_CloseError(t *testing.T) {
+	url := newServer(t, func(conn *websocket.Conn) {
+		msg := websocket.FormatCloseMessage(websocket.CloseInternalServerErr, "backend failure")
+		conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+		conn.ReadMessage()
+	})
+	p := newPool(t, url, Config{MaxConn: 1})
+
+	conn, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	defer conn.Release()
+
+	_, err = conn.ReadMessage()
+	var closeErr *CloseError
+	if !errors.As(err, &closeErr) {
+		t.Fatalf("ReadMessage error = %v, want *CloseError", err)
+	}
+	if closeErr.Code != websocket.CloseInternalServerErr || closeErr.Text != "backend failure" {
+		t.Errorf("CloseError = {%d %q}, want {%d %q}", closeErr.Code, closeErr.Text, websocket.CloseInternalServerErr, "backend failure")
+	}
+	if closeErr.Normal() {
+		t.Error("Normal() = true for code 1011")
+	}
+	var wsErr *websocket.CloseError
+	if !errors.As(err, &wsErr) {
+		t.Error("error does not unwrap to *websocket.CloseError")
+	}
+}
+
+func TestURLFunc(t *testing.T) {
+	first, second := newEchoServer(t), newEchoServer(t)
+	resolved := []string{first, second}
+	var calls int
+	p, err := New(Config{
+		Dialer: websocket.DefaultDialer,
+		URLFunc: func(ctx context.Context) (string, error) {
+			if calls == len(resolved) {
+				return "", errors.New("no backend registered")
+			}
+			url := resolved[calls]
+			calls++
+			return url, nil
+		},
+		MaxConn:           3,
+		HealthCheckPeriod: time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	t.Cleanup(func() { p.Close() })
+
+	for _, want := range resolved {
+		conn, err := p.Acquire(context.Background())
+		if err != nil {
+			t.Fatalf("Acquire: %v", err)
+		}
+		defer conn.Release()
+		if conn.URL() != want {
+			t.Errorf("connection dialed %s, want %s", conn.URL(), want)
+		}
+	}
+	if _, err := p.Acquire(context.Background()); err == nil {
+		t.Error("Acquire succeeded although URLFunc failed")
+	}
+	if got := p.Stats().DialErrorCount; got != 1 {
+		t.Errorf("DialErrorCount = %d, want 1", got)
+	}
+}
+
+func TestMaxReconnectAttempts(t *testing.T) {
+	url := newServer(t, func(conn *websocket.Conn) {
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(4000, "restart"))
+	})
+	var dials atomic.Int32
+	dialer := &websocket.Dialer{
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if dials.Add(1) > 1 {
+				return nil, errors.New("server down")
+			}
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}
+	p, err := New(Config{
+		Dialer: dialer,
+		URL:    url,
+		ErrorClassifier: func(err error) ErrorKind {
+			if websocket.IsCloseError(err, 4000) {
+				return ErrorRetriable
+			}
+			return DefaultErrorClassifier(err)
+		},
+		MaxReconnectAttempts: 3,
+		MaxConn:              1,
+		HealthCheckPeriod:    time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	t.Cleanup(func() { p.Close() })
+
+	conn, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	if _, err := conn.ReadMessage(); !errors.Is(err, ErrReconnectAbandoned) {
+		t.Fatalf("ReadMessage error = %v, want ErrReconnectAbandoned", err)
+	}
+	if got := dials.Load(); got != 4 {
+		t.Errorf("dials = %d, want 1 + 3 reconnect attempts", got)
+	}
+	conn.Release()
+	if got := p.Stats().ActiveConns; got != 0 {
+		t.Errorf("ActiveConns = %d, want the abandoned connection evicted", got)
+	}
+}
+
+func TestAcquireForSize(t *testing.T) {
+	url := newEchoServer(t)
+	p := newPool(t, url, Config{MinConn: 1, MaxConn: 1})
+	if got := p.idleConns()[0].writeBufferSize; got != defaultWriteBufferSize {
+		t.Fatalf("idle connection has a %d byte buffer, want the default", got)
+	}
+
+	const size = 64 << 10
+	conn, err := p.AcquireForSize(context.Background(), size)
+	if err != nil {
+		t.Fatalf("AcquireForSize: %v", err)
+	}
+	if conn.writeBufferSize < size {
+		t.Errorf("write buffer = %d bytes, want at least %d", conn.writeBufferSize, size)
+	}
+	if got := p.Stats().DialCount; got != 2 {
+		t.Errorf("DialCount = %d, want the small connection replaced", got)
+	}
+	if err := conn.SendBinary(make([]byte, size)); err != nil {
+		t.Errorf("SendBinary: %v", err)
+	}
+	large := conn
+	conn.Release()
+
+	// The large connection now satisfies small hints as well.
+	conn, err = p.AcquireForSize(context.Background(), 1024)
+	if err != nil {
+		t.Fatalf("AcquireForSize: %v", err)
+	}
+	defer conn.Release()
+	if conn.pooledConn != large.pooledConn {
+		t.Error("a suitable idle connection was not reused")
+	}
+}
+
+func TestAcquireForSize_SmallHintKeepsDefaultBuffer(t *testing.T) {
+	url := newEchoServer(t)
+	p := newPool(t, url, Config{MaxConn: 1})
+
+	conn, err := p.AcquireForSize(context.Background(), 16)
+	if err != nil {
+		t.Fatalf("AcquireForSize: %v", err)
+	}
+	defer conn.Release()
+	if got := conn.writeBufferSize; got != defaultWriteBufferSize {
+		t.Errorf("write buffer = %d bytes, want the default %d", got, defaultWriteBufferSize)
+	}
+}
+
+func TestAcquireSubprotocol(t *testing.T) {
+	var accepted atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		// Alternate the server's preference between connections.
+		u := upgrader
+		u.Subprotocols = []string{"v1", "v2"}
+		if accepted.Add(1)%2 == 0 {
+			u.Subprotocols = []string{"v2", "v1"}
+		}
+		conn, err := u.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	p, err := New(Config{
+		Dialer:            &websocket.Dialer{Subprotocols: []string{"v1", "v2"}},
+		URL:               "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws",
+		MinConn:           2,
+		MaxConn:           3,
+		HealthCheckPeriod: time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	t.Cleanup(func() { p.Close() })
+
+	for _, tc := range []struct{ proto, id string }{{"v2", "2"}, {"v1", "1"}} {
+		conn, err := p.AcquireSubprotocol(context.Background(), tc.proto)
+		if err != nil {
+			t.Fatalf("AcquireSubprotocol(%s): %v", tc.proto, err)
+		}
+		defer conn.Release()
+		if conn.Subprotocol() != tc.proto || conn.ID() != tc.id {
+			t.Errorf("AcquireSubprotocol(%s) = connection %s speaking %q, want connection %s", tc.proto, conn.ID(), conn.Subprotocol(), tc.id)
+		}
+	}
+
+	// Nothing idle speaks v2 any more, so a connection offering only v2 is
+	// dialed even though this server would prefer v1.
+	conn, err := p.AcquireSubprotocol(context.Background(), "v2")
+	if err != nil {
+		t.Fatalf("AcquireSubprotocol: %v", err)
+	}
+	defer conn.Release()
+	if conn.Subprotocol() != "v2" || conn.ID() != "3" {
+		t.Errorf("got connection %s speaking %q, want a new v2 connection", conn.ID(), conn.Subprotocol())
+	}
+}
+
+func TestAcquireSubprotocol_ReplacesDeadIdleConn(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u := upgrader
+		u.Subprotocols = []string{"v1"}
+		conn, err := u.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.ReadMessage()
+	}))
+	t.Cleanup(srv.Close)
+	p := newPool(t, "ws"+strings.TrimPrefix(srv.URL, "http"), Config{
+		Dialer:  &websocket.Dialer{Subprotocols: []string{"v1"}},
+		MinConn: 1,
+		MaxConn: 1,
+	})
+	p.idleConns()[0].c.NetConn().Close()
+
+	conn, err := p.AcquireSubprotocol(context.Background(), "v1")
+	if err != nil {
+		t.Fatalf("AcquireSubprotocol: %v", err)
+	}
+	defer conn.Release()
+	if got := p.Stats(); got.DialCount != 2 || got.EvictCount != 1 {
+		t.Errorf("DialCount = %d, EvictCount = %d; want the dead connection evicted and replaced", got.DialCount, got.EvictCount)
+	}
+}
+
+func TestLimiter_SharedAcrossPools(t *testing.T) {
+	url := newEchoServer(t)
+	limiter := NewLimiter(3)
+	a := newPool(t, url, Config{MaxConn: 2, Limiter: limiter})
+	b := newPool(t, url, Config{MaxConn: 2, Limiter: limiter})
+
+	a1, err := a.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	if _, err := a.Acquire(context.Background()); err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	if _, err := b.Acquire(context.Background()); err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	if _, err := b.Acquire(context.Background()); !errors.Is(err, ErrLimitReached) {
+		t.Fatalf("Acquire beyond the shared limit error = %v, want ErrLimitReached", err)
+	}
+	if got := limiter.Open(); got != 3 {
+		t.Errorf("Open = %d, want 3", got)
+	}
+
+	// Closing a connection in one pool frees a slot for the other.
+	a.Invalidate(a1)
+	a1.Release()
+	if got := limiter.Open(); got != 2 {
+		t.Errorf("Open = %d after close, want 2", got)
+	}
+	if _, err := b.Acquire(context.Background()); err != nil {
+		t.Errorf("Acquire after a slot was freed: %v", err)
+	}
+}
+
+func TestStats_UsesBeforeRetire(t *testing.T) {
+	url := newEchoServer(t)
+	p := newPool(t, url, Config{MaxConn: 1})
+
+	var conn *WsConn
+	for i := 0; i < 4; i++ {
+		var err error
+		if conn, err = p.Acquire(context.Background()); err != nil {
+			t.Fatalf("Acquire: %v", err)
+		}
+		if i < 3 {
+			conn.Release()
+		}
+	}
+	p.Invalidate(conn)
+	conn.Release()
+
+	stats := p.Stats()
+	if stats.RetireCount != 1 || stats.AvgUsesBeforeRetire != 4 {
+		t.Errorf("RetireCount = %d, AvgUsesBeforeRetire = %v; want 1 and 4", stats.RetireCount, stats.AvgUsesBeforeRetire)
+	}
+}
+
+func TestSendJSONIdempotent_RetriesWithSameKey(t *testing.T) {
+	url := newEchoServer(t)
+	errFlaky := errors.New("transient failure")
+	var attempts []string
+	p := newPool(t, url, Config{
+		MaxConn: 1,
+		SendInterceptor: func(messageType int, data []byte) ([]byte, error) {
+			attempts = append(attempts, string(data))
+			if len(attempts) == 1 {
+				return nil, errFlaky
+			}
+			return data, nil
+		},
+		ErrorClassifier: func(err error) ErrorKind {
+			if errors.Is(err, errFlaky) {
+				return ErrorRetriable
+			}
+			return DefaultErrorClassifier(err)
+		},
+	})
+
+	conn, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	defer conn.Release()
+
+	if err := conn.SendJSONIdempotent(context.Background(), "order-42", map[string]int{"qty": 1}); err != nil {
+		t.Fatalf("SendJSONIdempotent: %v", err)
+	}
+	if len(attempts) != 2 {
+		t.Fatalf("attempts = %d, want 2", len(attempts))
+	}
+	for i, a := range attempts {
+		var msg struct {
+			Key string `json:"idempotencyKey"`
+		}
+		if err := json.Unmarshal([]byte(a), &msg); err != nil || msg.Key != "order-42" {
+			t.Errorf("attempt %d carried key %q (%v), want %q", i+1, msg.Key, err, "order-42")
+		}
+	}
+	echoed, err := conn.ReadMessage()
+	if err != nil || string(echoed) != attempts[1] {
+		t.Errorf("server received %q, %v; want the retried message", echoed, err)
+	}
+}
+
+func TestFollowRedirects(t *testing.T) {
+	final := newEchoServer(t)
+	redirect := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http"+strings.TrimPrefix(final, "ws"), http.StatusTemporaryRedirect)
+	}))
+	t.Cleanup(redirect.Close)
+	start := "ws" + strings.TrimPrefix(redirect.URL, "http") + "/old"
+
+	if _, err := New(Config{Dialer: websocket.DefaultDialer, URL: start, MinConn: 1, MaxConn: 1, HealthCheckPeriod: time.Hour}); err == nil {
+		t.Error("redirect was followed without FollowRedirects")
+	}
+
+	p := newPool(t, start, Config{MaxConn: 1, FollowRedirects: 1})
+	conn, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	defer conn.Release()
+	if conn.URL() != final {
+		t.Errorf("URL = %s, want %s", conn.URL(), final)
+	}
+	if err := conn.SendMessage("hi"); err != nil {
+		t.Fatalf("SendMessage: %v", err)
+	}
+	if msg, err := conn.ReadMessage(); err != nil || string(msg) != "hi" {
+		t.Errorf("ReadMessage = %q, %v; want the echo", msg, err)
+	}
+}
+
+func TestOnDrainMessage(t *testing.T) {
+	url := newServer(t, func(conn *websocket.Conn) {
+		conn.WriteMessage(websocket.TextMessage, []byte("a"))
+		conn.WriteMessage(websocket.TextMessage, []byte("b"))
+		conn.ReadMessage()
+	})
+	drained := make(chan string, 2)
+	const lifetime = 50 * time.Millisecond
+	p := newPool(t, url, Config{
+		MinConn:         1,
+		MaxConn:         1,
+		MaxConnLifetime: lifetime,
+		DrainTimeout:    20 * time.Millisecond,
+		OnDrainMessage:  func(conn *WsConn, data []byte) { drained <- string(data) },
+	})
+
+	for _, want := range []string{"a", "b"} {
+		select {
+		case got := <-drained:
+			if got != want {
+				t.Errorf("drained %q, want %q", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("message %q was not drained", want)
+		}
+	}
+	deadline := time.Now().Add(time.Second)
+	for p.Stats().ActiveConns != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("drained connection was not closed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestOnDrainMessage_ExpiredWhileAcquired(t *testing.T) {
+	url := newServer(t, func(conn *websocket.Conn) {
+		conn.ReadMessage()
+		conn.WriteMessage(websocket.TextMessage, []byte("in flight"))
+		conn.ReadMessage()
+	})
+	drained := make(chan string, 1)
+	p := newPool(t, url, Config{
+		MaxConn:         1,
+		MaxConnLifetime: 50 * time.Millisecond,
+		DrainTimeout:    20 * time.Millisecond,
+		OnDrainMessage:  func(conn *WsConn, data []byte) { drained <- string(data) },
+	})
+
+	conn, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	if err := conn.SendMessage("go"); err != nil {
+		t.Fatalf("SendMessage: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond) // expires while acquired
+	conn.Release()
+
+	select {
+	case got := <-drained:
+		if got != "in flight" {
+			t.Errorf("drained %q, want %q", got, "in flight")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("in-flight message was not drained")
+	}
+	deadline := time.Now().Add(time.Second)
+	for p.Stats().ActiveConns != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("drained connection was not closed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWaitQueuePolicy(t *testing.T) {
+	url := newEchoServer(t)
+	for _, tc := range []struct {
+		name   string
+		policy WaitQueuePolicy
+		want   []int
+	}{
+		{"FIFO", WaitFIFO, []int{1, 2, 3}},
+		{"LIFO", WaitLIFO, []int{3, 2, 1}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := newPool(t, url, Config{MaxConn: 1, WaitQueuePolicy: tc.policy})
+			conn, err := p.Acquire(context.Background())
+			if err != nil {
+				t.Fatalf("Acquire: %v", err)
+			}
+
+			served := make(chan int, len(tc.want))
+			for i := 1; i <= len(tc.want); i++ {
+				go func() {
+					c, err := p.Acquire(context.Background())
+					if err != nil {
+						t.Errorf("waiter %d: %v", i, err)
+						served <- 0
+						return
+					}
+					served <- i
+					c.Release()
+				}()
+				// Let each waiter queue up before the next one arrives.
+				for p.Stats().WaitCount != int64(i) {
+					time.Sleep(time.Millisecond)
+				}
+			}
+			conn.Release()
+
+			for _, want := range tc.want {
+				if got := <-served; got != want {
+					t.Errorf("served waiter %d, want %d", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestAppPing(t *testing.T) {
+	// Neither server answers control pings; only the first answers
+	// application pings.
+	newAppServer := func(answer bool) string {
+		return newServer(t, func(conn *websocket.Conn) {
+			conn.SetPingHandler(func(string) error { return nil })
+			for {
+				_, msg, err := conn.ReadMessage()
+				if err != nil {
+					return
+				}
+				if answer && string(msg) == "ping" {
+					conn.WriteMessage(websocket.TextMessage, []byte("pong"))
+				}
+			}
+		})
+	}
+	config := func() Config {
+		return Config{
+			MinConn:           1,
+			MaxConn:           1,
+			HealthCheckPeriod: 20 * time.Millisecond,
+			ReadTimeout:       50 * time.Millisecond,
+			AppPingMessage:    []byte("ping"),
+			AppPongMatcher:    func(data []byte) bool { return string(data) == "pong" },
+		}
+	}
+
+	t.Run("alive", func(t *testing.T) {
+		p := newPool(t, newAppServer(true), config())
+		time.Sleep(150 * time.Millisecond)
+		if stats := p.Stats(); stats.EvictCount != 0 || stats.DialCount != 1 {
+			t.Errorf("stats = %+v, want the answering connection kept", stats)
+		}
+		conn, err := p.Acquire(context.Background())
+		if err != nil {
+			t.Fatalf("Acquire: %v", err)
+		}
+		conn.Release()
+		if got := p.Stats().DialCount; got != 1 {
+			t.Errorf("DialCount = %d, want the idle connection reused", got)
+		}
+	})
+
+	t.Run("pushed message kept", func(t *testing.T) {
+		url := newServer(t, func(conn *websocket.Conn) {
+			conn.WriteMessage(websocket.TextMessage, []byte("news"))
+			for {
+				_, msg, err := conn.ReadMessage()
+				if err != nil {
+					return
+				}
+				if string(msg) == "ping" {
+					conn.WriteMessage(websocket.TextMessage, []byte("pong"))
+				}
+			}
+		})
+		p := newPool(t, url, config())
+		time.Sleep(100 * time.Millisecond) // let the health check ping
+		conn, err := p.Acquire(context.Background())
+		if err != nil {
+			t.Fatalf("Acquire: %v", err)
+		}
+		defer conn.Release()
+		if got, err := conn.ReadMessage(); err != nil || string(got) != "news" {
+			t.Errorf("ReadMessage = %q, %v; want the message pushed while idle", got, err)
+		}
+	})
+
+	t.Run("not released", func(t *testing.T) {
+		// Verified connections go straight back to the idle store without
+		// passing through the release policies.
+		var calls atomic.Int32
+		cfg := config()
+		cfg.ShouldPoolOnRelease = func(*WsConn) bool {
+			calls.Add(1)
+			return false
+		}
+		p := newPool(t, newAppServer(true), cfg)
+		time.Sleep(150 * time.Millisecond)
+		if got := calls.Load(); got != 0 {
+			t.Errorf("ShouldPoolOnRelease called %d times, want 0", got)
+		}
+		// The connection may be out of the idle store for a ping right now.
+		if stats := p.Stats(); stats.ActiveConns != 1 || stats.DialCount != 1 {
+			t.Errorf("stats = %+v, want the verified connection kept", stats)
+		}
+	})
+
+	t.Run("unresponsive", func(t *testing.T) {
+		p := newPool(t, newAppServer(false), config())
+		deadline := time.Now().Add(time.Second)
+		for p.Stats().EvictCount == 0 {
+			if time.Now().After(deadline) {
+				t.Fatal("unresponsive connection was not evicted")
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	})
+}
+
+func TestWithPriority(t *testing.T) {
+	url := newEchoServer(t)
+	p := newPool(t, url, Config{MaxConn: 1})
+	conn, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+
+	served := make(chan string, 2)
+	wait := func(name string, ctx context.Context) {
+		go func() {
+			c, err := p.Acquire(ctx)
+			if err != nil {
+				t.Errorf("%s: %v", name, err)
+				served <- ""
+				return
+			}
+			served <- name
+			c.Release()
+		}()
+	}
+	wait("default", context.Background())
+	for p.Stats().WaitCount != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	wait("high", WithPriority(context.Background(), 10))
+	for p.Stats().WaitCount != 2 {
+		time.Sleep(time.Millisecond)
+	}
+	conn.Release()
+
+	if got := <-served; got != "high" {
+		t.Errorf("first served %q, want the high-priority waiter", got)
+	}
+	<-served
+}
+
+// countingListener counts the bytes read from its connections.
+type countingListener struct {
+	net.Listener
+	n *atomic.Int64
+}
+
+func (l countingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	return countingConn{c, l.n}, err
+}
+
+type countingConn struct {
+	net.Conn
+	n *atomic.Int64
+}
+
+func (c countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+func TestCompressionLevel(t *testing.T) {
+	var received atomic.Int64
+	got := make(chan struct{}, 1)
+	u := websocket.Upgrader{EnableCompression: true}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := u.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+			got <- struct{}{}
+		}
+	}))
+	srv.Listener = countingListener{srv.Listener, &received}
+	srv.Start()
+	t.Cleanup(srv.Close)
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	// Repetitive text compresses far better with LZ matching (level 9) than
+	// with Huffman coding alone (level -2).
+	payload := strings.Repeat("the quick brown fox jumps over the lazy dog ", 2000)
+	sent := func(level int) int64 {
+		p := newPool(t, url, Config{
+			Dialer:           &websocket.Dialer{EnableCompression: true},
+			MaxConn:          1,
+			CompressionLevel: level,
+		})
+		conn, err := p.Acquire(context.Background())
+		if err != nil {
+			t.Fatalf("Acquire: %v", err)
+		}
+		defer conn.Release()
+		before := received.Load()
+		if err := conn.SendMessage(payload); err != nil {
+			t.Fatalf("SendMessage: %v", err)
+		}
+		<-got
+		return received.Load() - before
+	}
+
+	huffman, best := sent(flate.HuffmanOnly), sent(flate.BestCompression)
+	if best*2 > huffman {
+		t.Errorf("level 9 sent %d bytes, level -2 sent %d; want level 9 much smaller", best, huffman)
+	}
+}
+
+func TestSaturation(t *testing.T) {
+	url := newEchoServer(t)
+	p := newPool(t, url, Config{MaxConn: 4})
+
+	if got := p.Saturation(); got != 0 {
+		t.Errorf("Saturation = %v on an empty pool, want 0", got)
+	}
+	conns, err := p.AcquireN(context.Background(), 3)
+	if err != nil {
+		t.Fatalf("AcquireN: %v", err)
+	}
+	if got := p.Saturation(); got != 0.75 {
+		t.Errorf("Saturation = %v with 3 of 4 connections, want 0.75", got)
+	}
+	if got := p.Stats().Saturation; got != 0.75 {
+		t.Errorf("Stats().Saturation = %v, want 0.75", got)
+	}
+	last, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	if got := p.Saturation(); got != 1 {
+		t.Errorf("Saturation = %v at capacity, want 1", got)
+	}
+	last.Release()
+	for _, c := range conns {
+		c.Release()
+	}
+}
+
+func TestOnEvict_Reasons(t *testing.T) {
+	url := newEchoServer(t)
+	for _, tc := range []struct {
+		name   string
+		config Config
+		want   EvictReason
+	}{
+		{"idle", Config{MaxConnIdleTime: 30 * time.Millisecond, HealthCheckPeriod: 10 * time.Millisecond}, EvictIdle},
+		{"lifetime", Config{MaxConnLifetime: 30 * time.Millisecond}, EvictExpired},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			evicted := make(chan EvictReason, 1)
+			cfg := tc.config
+			cfg.MinConn, cfg.MaxConn = 1, 1
+			cfg.OnEvict = func(conn *WsConn, reason EvictReason) { evicted <- reason }
+			newPool(t, url, cfg)
+
+			select {
+			case got := <-evicted:
+				if got != tc.want {
+					t.Errorf("reason = %v, want %v", got, tc.want)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("OnEvict was not called")
+			}
+		})
+	}
+}
+
+func TestAcquire_CountsDeadIdleConn(t *testing.T) {
+	url := newEchoServer(t)
+	evicted := make(chan EvictReason, 1)
+	p := newPool(t, url, Config{
+		MinConn: 1,
+		MaxConn: 1,
+		OnEvict: func(conn *WsConn, reason EvictReason) { evicted <- reason },
+	})
+	p.idleConns()[0].c.NetConn().Close()
+
+	conn, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	defer conn.Release()
+	select {
+	case got := <-evicted:
+		if got != EvictBroken {
+			t.Errorf("reason = %v, want %v", got, EvictBroken)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnEvict was not called")
+	}
+	if got := p.Stats(); got.EvictCount != 1 || got.DialCount != 2 {
+		t.Errorf("EvictCount = %d, DialCount = %d; want the dead connection counted and replaced", got.EvictCount, got.DialCount)
+	}
+}
+
+func TestOnEvict_Displaced(t *testing.T) {
+	url, other := newEchoServer(t), newEchoServer(t)
+	evicted := make(chan EvictReason, 1)
+	p := newPool(t, url, Config{
+		MinConn: 1,
+		MaxConn: 1,
+		OnEvict: func(conn *WsConn, reason EvictReason) { evicted <- reason },
+	})
+
+	// The idle connection to url must make room for one to other.
+	conn, err := p.AcquireURL(context.Background(), other)
+	if err != nil {
+		t.Fatalf("AcquireURL: %v", err)
+	}
+	defer conn.Release()
+	select {
+	case got := <-evicted:
+		if got != EvictDisplaced {
+			t.Errorf("reason = %v, want %v", got, EvictDisplaced)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnEvict was not called")
+	}
+	if got := p.Stats().EvictCount; got != 1 {
+		t.Errorf("EvictCount = %d, want 1", got)
+	}
+}
+
+func TestDefaultWriteContext(t *testing.T) {
+	stall := make(chan struct{})
+	url := newServer(t, func(conn *websocket.Conn) {
+		// Never read, so large writes back up.
+		<-stall
+	})
+	t.Cleanup(func() { close(stall) })
+	var writeCtx context.Context
+	p := newPool(t, url, Config{
+		MaxConn:             1,
+		DefaultWriteContext: func() context.Context { return writeCtx },
+	})
+
+	conn, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	defer conn.Release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	writeCtx = ctx
+	start := time.Now()
+	err = conn.SendBinary(make([]byte, 16<<20))
+	if err == nil {
+		t.Fatal("expected the send to hit the default context's deadline")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("send took %v, want it bounded by the 100ms deadline", elapsed)
+	}
+	if !conn.broken.Load() {
+		t.Error("connection was not marked broken")
+	}
+}
+
+func TestSubscribe_RestoredOnReconnect(t *testing.T) {
+	var dials atomic.Int32
+	restored := make(chan []string, 1)
+	url := newServer(t, func(conn *websocket.Conn) {
+		if dials.Add(1) == 1 {
+			// Subscribe a, b and c, unsubscribe b, then restart.
+			for range 4 {
+				conn.ReadMessage()
+			}
+			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(4000, "restart"))
+			return
+		}
+		var frames []string
+		for range 2 {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			frames = append(frames, string(data))
+		}
+		restored <- frames
+		conn.WriteMessage(websocket.TextMessage, []byte("hello"))
+		conn.ReadMessage()
+	})
+	classifier := func(err error) ErrorKind {
+		if websocket.IsCloseError(err, 4000) {
+			return ErrorRetriable
+		}
+		return DefaultErrorClassifier(err)
+	}
+	p := newPool(t, url, Config{MaxConn: 1, ErrorClassifier: classifier})
+
+	conn, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	defer conn.Release()
+
+	for _, topic := range []string{"a", "b", "c", "a"} {
+		if err := conn.Subscribe(topic); err != nil {
+			t.Fatalf("Subscribe(%q): %v", topic, err)
+		}
+	}
+	if err := conn.Unsubscribe("b"); err != nil {
+		t.Fatalf("Unsubscribe: %v", err)
+	}
+
+	// The read sees the restart, redials and restores the subscriptions.
+	if _, err := conn.ReadMessage(); err != nil {
+		t.Fatalf("ReadMessage: %v", err)
+	}
+	want := []string{
+		`{"action":"subscribe","topic":"a"}`,
+		`{"action":"subscribe","topic":"c"}`,
+	}
+	if got := <-restored; !slices.Equal(got, want) {
+		t.Errorf("restored frames = %q, want %q", got, want)
+	}
+	if got := conn.Subscriptions(); !slices.Equal(got, []string{"a", "c"}) {
+		t.Errorf("Subscriptions() = %q, want [a c]", got)
+	}
+}
+
+func TestMaxAcquireDuration_ReportsLeak(t *testing.T) {
+	url := newEchoServer(t)
+
+	t.Run("report", func(t *testing.T) {
+		leaks := make(chan string, 1)
+		p := newPool(t, url, Config{
+			MaxConn:            1,
+			MaxAcquireDuration: 50 * time.Millisecond,
+			OnLeak: func(conn *WsConn, stack []byte) {
+				leaks <- string(stack)
+			},
+		})
+
+		start := time.Now()
+		conn, err := p.Acquire(context.Background())
+		if err != nil {
+			t.Fatalf("Acquire: %v", err)
+		}
+		defer conn.Release()
+
+		select {
+		case stack := <-leaks:
+			if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+				t.Errorf("leak reported after %v, want at least 50ms", elapsed)
+			}
+			if !strings.Contains(stack, "TestMaxAcquireDuration_ReportsLeak") {
+				t.Errorf("stack does not show the acquiring caller:\n%s", stack)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("OnLeak was not called")
+		}
+	})
+
+	t.Run("released in time", func(t *testing.T) {
+		var leaked atomic.Bool
+		p := newPool(t, url, Config{
+			MaxConn:            1,
+			MaxAcquireDuration: 50 * time.Millisecond,
+			OnLeak:             func(*WsConn, []byte) { leaked.Store(true) },
+		})
+		conn, err := p.Acquire(context.Background())
+		if err != nil {
+			t.Fatalf("Acquire: %v", err)
+		}
+		conn.Release()
+		time.Sleep(100 * time.Millisecond)
+		if leaked.Load() {
+			t.Error("OnLeak called for a released connection")
+		}
+	})
+
+	t.Run("reclaim", func(t *testing.T) {
+		evicted := make(chan EvictReason, 1)
+		p := newPool(t, url, Config{
+			MaxConn:            1,
+			MaxAcquireDuration: 50 * time.Millisecond,
+			ReclaimLeaks:       true,
+			OnEvict:            func(_ *WsConn, reason EvictReason) { evicted <- reason },
+		})
+		conn, err := p.Acquire(context.Background())
+		if err != nil {
+			t.Fatalf("Acquire: %v", err)
+		}
+		select {
+		case reason := <-evicted:
+			if reason != EvictLeaked {
+				t.Errorf("reason = %v, want %v", reason, EvictLeaked)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("leaked connection was not reclaimed")
+		}
+		if conn.Lease() != 0 {
+			t.Error("lease of the reclaimed connection was not revoked")
+		}
+		// The slot is free again.
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		next, err := p.Acquire(ctx)
+		if err != nil {
+			t.Fatalf("Acquire after reclaim: %v", err)
+		}
+		next.Release()
+	})
+}
+
+func TestAcquireReaderWriter_SeparateCapacity(t *testing.T) {
+	url := newEchoServer(t)
+	p := newPool(t, url, Config{MaxConn: 1, MaxReaders: 2, MaxWriters: 1})
+
+	acquireTimeout := func(acquire func(context.Context) (*WsConn, error)) (*WsConn, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		return acquire(ctx)
+	}
+
+	var readers []*WsConn
+	for range 2 {
+		conn, err := acquireTimeout(p.AcquireReader)
+		if err != nil {
+			t.Fatalf("AcquireReader: %v", err)
+		}
+		defer conn.Release()
+		readers = append(readers, conn)
+	}
+	if _, err := acquireTimeout(p.AcquireReader); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("third AcquireReader: err = %v, want DeadlineExceeded", err)
+	}
+
+	// Exhausted readers do not block writers or the main pool.
+	writer, err := acquireTimeout(p.AcquireWriter)
+	if err != nil {
+		t.Fatalf("AcquireWriter: %v", err)
+	}
+	defer writer.Release()
+	if _, err := acquireTimeout(p.AcquireWriter); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("second AcquireWriter: err = %v, want DeadlineExceeded", err)
+	}
+	conn, err := acquireTimeout(p.Acquire)
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	defer conn.Release()
+
+	if err := writer.SendMessage("ping"); err != nil {
+		t.Fatalf("SendMessage: %v", err)
+	}
+	if got, err := writer.ReadMessage(); err != nil || string(got) != "ping" {
+		t.Errorf("echo = %q, %v; want %q", got, err, "ping")
+	}
+
+	// A released reader frees reader capacity only.
+	readers[0].Release()
+	next, err := acquireTimeout(p.AcquireReader)
+	if err != nil {
+		t.Fatalf("AcquireReader after release: %v", err)
+	}
+	next.Release()
+}
+
+func TestAcquireReaderWriter_UniqueIDs(t *testing.T) {
+	url := newEchoServer(t)
+	p := newPool(t, url, Config{MaxConn: 1, MaxReaders: 1, MaxWriters: 1})
+
+	for _, acquire := range []func(context.Context) (*WsConn, error){p.Acquire, p.AcquireReader, p.AcquireWriter} {
+		conn, err := acquire(context.Background())
+		if err != nil {
+			t.Fatalf("acquire: %v", err)
+		}
+		conn.Release()
+	}
+	infos := p.DebugSnapshot()
+	if len(infos) != 3 {
+		t.Fatalf("DebugSnapshot has %d connections, want 3", len(infos))
+	}
+	seen := make(map[string]bool)
+	for _, info := range infos {
+		if seen[info.ID] {
+			t.Errorf("ID %q is used by more than one connection", info.ID)
+		}
+		seen[info.ID] = true
+	}
+}
+
+func TestAcquireReader_ManagedThroughParent(t *testing.T) {
+	url := newEchoServer(t)
+	p := newPool(t, url, Config{MaxConn: 1, MaxReaders: 1})
+
+	conn, err := p.AcquireReader(context.Background())
+	if err != nil {
+		t.Fatalf("AcquireReader: %v", err)
+	}
+	conn.Release()
+	if got := p.Stats(); got.ActiveConns != 1 || got.IdleConns != 1 || got.MaxConns != 2 {
+		t.Errorf("Stats = %+v, want the reader counted", got)
+	}
+	if got := len(p.DebugSnapshot()); got != 1 {
+		t.Errorf("DebugSnapshot has %d connections, want 1", got)
+	}
+
+	p.Invalidate(conn)
+	if got := p.Stats().ActiveConns; got != 0 {
+		t.Errorf("ActiveConns = %d after Invalidate, want 0", got)
+	}
+
+	p.readers.reportError(errors.New("reader failed"))
+	select {
+	case err := <-p.Errors():
+		if err.Error() != "reader failed" {
+			t.Errorf("Errors() = %v, want the reader's error", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("reader error was not forwarded")
+	}
+}
+
+func TestClosedConn_ReturnsErrConnClosed(t *testing.T) {
+	url := newEchoServer(t)
+	p := newPool(t, url, Config{MaxConn: 1})
+
+	conn, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	if err := conn.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if _, err := conn.ReadMessage(); !errors.Is(err, ErrConnClosed) {
+		t.Errorf("ReadMessage: err = %v, want ErrConnClosed", err)
+	}
+	var v any
+	if err := conn.ReadJSON(&v); !errors.Is(err, ErrConnClosed) {
+		t.Errorf("ReadJSON: err = %v, want ErrConnClosed", err)
+	}
+	if err := conn.SendMessage("hello"); !errors.Is(err, ErrConnClosed) {
+		t.Errorf("SendMessage: err = %v, want ErrConnClosed", err)
+	}
+	if err := conn.CancelRead(); !errors.Is(err, ErrConnClosed) {
+		t.Errorf("CancelRead: err = %v, want ErrConnClosed", err)
+	}
+}
+
+// fifoStore is an idleStore that hands out the least recently released
+// connection first.
+type fifoStore struct {
+	lifoStore
+}
+
+func (s *fifoStore) Get(match func(*WsConn) bool) *WsConn {
+	for i, conn := range s.conns {
+		if match(conn) {
+			s.conns = slices.Delete(s.conns, i, i+1)
+			return conn
+		}
+	}
+	return nil
+}
+
+func TestIdleStore_Order(t *testing.T) {
+	url := newEchoServer(t)
+
+	acquireAfterReleases := func(t *testing.T, store idleStore) (released []*WsConn, got *WsConn) {
+		p := newPool(t, url, Config{MaxConn: 3})
+		if store != nil {
+			p.lock.Lock()
+			p.idle = store
+			p.lock.Unlock()
+		}
+		var conns []*WsConn
+		for range 3 {
+			conn, err := p.Acquire(context.Background())
+			if err != nil {
+				t.Fatalf("Acquire: %v", err)
+			}
+			conns = append(conns, conn)
+		}
+		for _, conn := range conns {
+			conn.Release()
+		}
+		conn, err := p.Acquire(context.Background())
+		if err != nil {
+			t.Fatalf("Acquire: %v", err)
+		}
+		defer conn.Release()
+		if got := p.Stats().IdleConns; got != 2 {
+			t.Errorf("IdleConns = %d, want 2", got)
+		}
+		return conns, conn
+	}
+
+	t.Run("default LIFO", func(t *testing.T) {
+		if released, got := acquireAfterReleases(t, nil); got.pooledConn != released[2].pooledConn {
+			t.Error("got an older connection, want the most recently released")
+		}
+	})
+	t.Run("FIFO", func(t *testing.T) {
+		if released, got := acquireAfterReleases(t, &fifoStore{}); got.pooledConn != released[0].pooledConn {
+			t.Error("got a newer connection, want the least recently released")
+		}
+	})
+}
+
+func TestErrors_BackgroundDialFailures(t *testing.T) {
+	var reject atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if reject.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.ReadMessage()
+	}))
+	t.Cleanup(srv.Close)
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	p := newPool(t, url, Config{MaxConn: 2, MinConn: 1, MinIdleConn: 1})
+	reject.Store(true)
+
+	// Evicting the idle connection makes the pool dial a replacement in the
+	// background, which the server rejects.
+	p.lock.Lock()
+	idle := p.idleConns()[0]
+	p.lock.Unlock()
+	p.Invalidate(idle)
+
+	select {
+	case err := <-p.Errors():
+		if !errors.Is(err, websocket.ErrBadHandshake) {
+			t.Errorf("err = %v, want a bad handshake", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no error reported on Errors")
+	}
+
+	t.Run("drops oldest", func(t *testing.T) {
+		p := newPool(t, newEchoServer(t), Config{MaxConn: 1})
+		for i := range errorsBuffer + 1 {
+			p.reportError(fmt.Errorf("error %d", i))
+		}
+		if n := len(p.Errors()); n != errorsBuffer {
+			t.Fatalf("buffered %d errors, want %d", n, errorsBuffer)
+		}
+		if err := <-p.Errors(); err.Error() != "error 1" {
+			t.Errorf("oldest buffered error = %v, want error 1", err)
+		}
+	})
+}
+
+func TestAcquireByKey_ConsistentURL(t *testing.T) {
+	urls := []string{newEchoServer(t), newEchoServer(t), newEchoServer(t)}
+	p := newPool(t, "", Config{MaxConn: 3, URLs: urls})
+
+	keyURL := func(key string) string {
+		conn, err := p.AcquireByKey(context.Background(), key)
+		if err != nil {
+			t.Fatalf("AcquireByKey(%q): %v", key, err)
+		}
+		defer conn.Release()
+		return conn.URL()
+	}
+
+	mapping := make(map[string]string)
+	used := make(map[string]bool)
+	for i := range 30 {
+		key := fmt.Sprintf("user-%d", i)
+		mapping[key] = keyURL(key)
+		used[mapping[key]] = true
+	}
+	if len(used) < 2 {
+		t.Errorf("30 keys mapped to %d URL(s), want them spread", len(used))
+	}
+	for key, want := range mapping {
+		if got := keyURL(key); got != want {
+			t.Errorf("key %q: URL %s, previously %s", key, got, want)
+		}
+	}
+
+	// Removing a URL only remaps the keys that were on it.
+	shrunk := newPool(t, "", Config{MaxConn: 1, URLs: urls[:2]})
+	for key, url := range mapping {
+		if url == urls[2] {
+			continue
+		}
+		shrunk.lock.Lock()
+		got := shrunk.keyURL(key)
+		shrunk.lock.Unlock()
+		if got != url {
+			t.Errorf("key %q moved from %s to %s", key, url, got)
+		}
+	}
+}
+
+func TestMaxPendingDials_CapsConcurrentDials(t *testing.T) {
+	var inFlight, peak atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		for {
+			old := peak.Load()
+			if n <= old || peak.CompareAndSwap(old, n) {
+				break
+			}
+		}
+		time.Sleep(50 * time.Millisecond) // a slow handshake
+		inFlight.Add(-1)
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.ReadMessage()
+	}))
+	t.Cleanup(srv.Close)
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	const burst, maxPending = 8, 2
+	p := newPool(t, url, Config{MaxConn: burst, MaxPendingDials: maxPending})
+
+	conns := make(chan *WsConn, burst)
+	var wg sync.WaitGroup
+	for range burst {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			conn, err := p.Acquire(ctx)
+			if err != nil {
+				t.Errorf("Acquire: %v", err)
+				return
+			}
+			conns <- conn
+		}()
+	}
+	wg.Wait()
+	close(conns)
+	for conn := range conns {
+		conn.Release()
+	}
+
+	if got := peak.Load(); got > maxPending {
+		t.Errorf("peak concurrent dials = %d, want at most %d", got, maxPending)
+	}
+	if got := peak.Load(); got < 2 {
+		t.Errorf("peak concurrent dials = %d, want dials to overlap", got)
+	}
+	if got := p.Stats().ActiveConns; got != burst {
+		t.Errorf("ActiveConns = %d, want %d", got, burst)
+	}
+}
+
+func TestMaxPendingDials_TryAcquireDoesNotWait(t *testing.T) {
+	dialing := make(chan struct{}, 1)
+	unblock := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dialing <- struct{}{}
+		<-unblock
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.ReadMessage()
+	}))
+	t.Cleanup(srv.Close)
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+	p := newPool(t, url, Config{MaxConn: 2, MaxPendingDials: 1})
+
+	acquired := make(chan *WsConn, 1)
+	go func() {
+		conn, err := p.Acquire(context.Background())
+		if err != nil {
+			t.Errorf("Acquire: %v", err)
+		}
+		acquired <- conn
+	}()
+	<-dialing
+
+	done := make(chan bool, 1)
+	go func() {
+		conn, ok := p.TryAcquire()
+		if ok {
+			conn.Release()
+		}
+		done <- ok
+	}()
+	select {
+	case ok := <-done:
+		if ok {
+			t.Error("TryAcquire succeeded while the only dial slot was taken")
+		}
+	case <-time.After(time.Second):
+		t.Error("TryAcquire waited for the pending dial")
+	}
+	close(unblock)
+	if conn := <-acquired; conn != nil {
+		conn.Release()
+	}
+}
+
+func TestMaxPendingDials_OnMaxConnReachedOnce(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond) // let the dials overlap
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.ReadMessage()
+	}))
+	t.Cleanup(srv.Close)
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	var reached atomic.Int32
+	const conns = 4
+	p := newPool(t, url, Config{
+		MaxConn:          conns,
+		MaxPendingDials:  conns,
+		OnMaxConnReached: func() { reached.Add(1) },
+	})
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		acquired []*WsConn
+	)
+	for range conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := p.Acquire(context.Background())
+			if err != nil {
+				t.Errorf("Acquire: %v", err)
+				return
+			}
+			mu.Lock()
+			acquired = append(acquired, conn)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	for _, conn := range acquired {
+		conn.Release()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if got := reached.Load(); got != 1 {
+		t.Errorf("OnMaxConnReached fired %d times, want 1", got)
+	}
+}
+
+func TestOpenStream_Multiplexes(t *testing.T) {
+	url := newServer(t, func(conn *websocket.Conn) {
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			var msg muxMessage
+			if err := json.Unmarshal(data, &msg); err != nil {
+				return
+			}
+			msg.Data = "echo:" + msg.Data
+			if err := conn.WriteJSON(msg); err != nil {
+				return
+			}
+		}
+	})
+	p := newPool(t, url, Config{MaxConn: 4})
+
+	const streams, messages = 4, 5
+	var wg sync.WaitGroup
+	for range streams {
+		s, err := p.OpenStream(context.Background())
+		if err != nil {
+			t.Fatalf("OpenStream: %v", err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer s.Close()
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			for i := range messages {
+				msg := fmt.Sprintf("%s-%d", s.ID(), i)
+				if err := s.Send(msg); err != nil {
+					t.Errorf("stream %s: Send: %v", s.ID(), err)
+					return
+				}
+				got, err := s.Receive(ctx)
+				if err != nil {
+					t.Errorf("stream %s: Receive: %v", s.ID(), err)
+					return
+				}
+				if want := "echo:" + msg; string(got) != want {
+					t.Errorf("stream %s received %q, want %q", s.ID(), got, want)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := p.Stats().DialCount; got != 1 {
+		t.Errorf("DialCount = %d, want every stream on one connection", got)
+	}
+	// Closing the last stream gives the connection back.
+	deadline := time.Now().Add(time.Second)
+	for p.Stats().ActiveConns != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := p.Stats().ActiveConns; got != 0 {
+		t.Errorf("ActiveConns = %d after closing every stream, want 0", got)
+	}
+
+	s, err := p.OpenStream(context.Background())
+	if err != nil {
+		t.Fatalf("OpenStream after close: %v", err)
+	}
+	s.Close()
+	if _, err := s.Receive(context.Background()); !errors.Is(err, ErrStreamClosed) {
+		t.Errorf("Receive on closed stream: err = %v, want ErrStreamClosed", err)
+	}
+}
+
+func TestOpenStream_SendsThroughReconnect(t *testing.T) {
+	var dials atomic.Int32
+	url := newServer(t, func(conn *websocket.Conn) {
+		first := dials.Add(1) == 1
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			var msg muxMessage
+			if err := json.Unmarshal(data, &msg); err != nil {
+				return
+			}
+			msg.Data = "echo:" + msg.Data
+			if err := conn.WriteJSON(msg); err != nil {
+				return
+			}
+			if first && msg.Data == "echo:first" {
+				// The first connection is restarted while streams are busy.
+				conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(4000, "restart"))
+				return
+			}
+		}
+	})
+	var intercepted atomic.Int32
+	p := newPool(t, url, Config{
+		MaxConn:         1,
+		ErrorClassifier: func(error) ErrorKind { return ErrorRetriable },
+		SendInterceptor: func(messageType int, data []byte) ([]byte, error) {
+			intercepted.Add(1)
+			return data, nil
+		},
+	})
+
+	s, err := p.OpenStream(context.Background())
+	if err != nil {
+		t.Fatalf("OpenStream: %v", err)
+	}
+	defer s.Close()
+	busy, err := p.OpenStream(context.Background())
+	if err != nil {
+		t.Fatalf("OpenStream: %v", err)
+	}
+	defer busy.Close()
+
+	// Keep another stream sending while the connection is redialed.
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			busy.Send("busy")
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := s.Send("first"); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if got, err := s.Receive(ctx); err != nil || string(got) != "echo:first" {
+		t.Fatalf("Receive = %q, %v; want %q", got, err, "echo:first")
+	}
+	deadline := time.Now().Add(time.Second)
+	for dials.Load() < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(stop)
+	<-done
+	if n := dials.Load(); n != 2 {
+		t.Fatalf("server saw %d connections, want 2", n)
+	}
+
+	if err := s.Send("second"); err != nil {
+		t.Fatalf("Send after reconnect: %v", err)
+	}
+	if got, err := s.Receive(ctx); err != nil || string(got) != "echo:second" {
+		t.Errorf("Receive after reconnect = %q, %v; want %q", got, err, "echo:second")
+	}
+	// Stream frames take the connection's send path.
+	if n := intercepted.Load(); n < 2 {
+		t.Errorf("SendInterceptor saw %d frames, want every stream send", n)
+	}
+}
+
+func TestTransferState_AfterRotation(t *testing.T) {
+	oldURL, newURL := newEchoServer(t), newEchoServer(t)
+	type sessionKey struct{}
+	transfers := make(chan [2]*WsConn, 1)
+	p := newPool(t, oldURL, Config{
+		MaxConn: 1,
+		TransferState: func(old, new *WsConn) error {
+			new.SetValue(sessionKey{}, old.Value(sessionKey{}))
+			transfers <- [2]*WsConn{old, new}
+			return nil
+		},
+	})
+
+	old, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	old.SetValue(sessionKey{}, "session-42")
+	old.Release()
+
+	if err := p.DrainURL(context.Background(), oldURL, newURL); err != nil {
+		t.Fatalf("DrainURL: %v", err)
+	}
+	select {
+	case pair := <-transfers:
+		if pair[0] != old || pair[1] == old {
+			t.Errorf("TransferState got (%p, %p), want the old connection and its replacement", pair[0], pair[1])
+		}
+	default:
+		t.Fatal("TransferState was not called")
+	}
+
+	conn, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	defer conn.Release()
+	if conn.URL() != newURL {
+		t.Fatalf("URL = %s, want the replacement on %s", conn.URL(), newURL)
+	}
+	if got := conn.Value(sessionKey{}); got != "session-42" {
+		t.Errorf("Value = %v, want the state of the old connection", got)
+	}
+}
+
+func TestPooledSince_DrivesIdleEviction(t *testing.T) {
+	url := newEchoServer(t)
+	const idle = 100 * time.Millisecond
+	p := newPool(t, url, Config{MaxConn: 1, MaxConnIdleTime: idle, HealthCheckPeriod: time.Hour})
+
+	conn, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	if err := conn.SendMessage("hello"); err != nil {
+		t.Fatalf("SendMessage: %v", err)
+	}
+	lastUsed := time.Now()
+	// Hold the connection without using it for longer than MaxConnIdleTime.
+	time.Sleep(idle + 50*time.Millisecond)
+	conn.Release()
+	if !conn.PooledSince().After(lastUsed) {
+		t.Errorf("PooledSince = %v, want the release time after the last use at %v", conn.PooledSince(), lastUsed)
+	}
+
+	p.checkHealth()
+	if got := idleCount(p); got != 1 {
+		t.Fatalf("idle = %d right after release, want the connection kept", got)
+	}
+
+	time.Sleep(idle + 50*time.Millisecond)
+	p.checkHealth()
+	if got := idleCount(p); got != 0 {
+		t.Errorf("idle = %d after MaxConnIdleTime in the pool, want 0", got)
+	}
+}
+
+// BenchmarkWriteBufferPool dials connections with large write buffers and
+// sends one message on each. With SharedWriteBuffers the connections reuse
+// pooled buffers instead of each allocating its own, which shows in B/op.
+func BenchmarkWriteBufferPool(b *testing.B) {
+	for _, shared := range []bool{false, true} {
+		name := "unshared"
+		if shared {
+			name = "shared"
+		}
+		b.Run(name, func(b *testing.B) {
+			url := newEchoServer(b)
+			dialer := &websocket.Dialer{WriteBufferSize: 64 << 10}
+			const conns = 16
+			b.ReportAllocs()
+			for range b.N {
+				p, err := New(Config{
+					Dialer:             dialer,
+					URL:                url,
+					MaxConn:            conns,
+					HealthCheckPeriod:  time.Hour,
+					SharedWriteBuffers: shared,
+				})
+				if err != nil {
+					b.Fatalf("New: %v", err)
+				}
+				acquired := make([]*WsConn, 0, conns)
+				for range conns {
+					conn, err := p.Acquire(context.Background())
+					if err != nil {
+						b.Fatalf("Acquire: %v", err)
+					}
+					if err := conn.SendMessage("hello"); err != nil {
+						b.Fatalf("SendMessage: %v", err)
+					}
+					acquired = append(acquired, conn)
+				}
+				// Close only closes idle connections.
+				for _, conn := range acquired {
+					conn.Release()
+				}
+				p.Close()
+			}
+		})
+	}
+}
+
+func TestWriteBufferPool_SharedByConnections(t *testing.T) {
+	url := newEchoServer(t)
+	dialer := &websocket.Dialer{}
+	p := newPool(t, url, Config{Dialer: dialer, MaxConn: 1, SharedWriteBuffers: true})
+
+	if p.config.Dialer.WriteBufferPool == nil {
+		t.Fatal("connections are dialed without a WriteBufferPool")
+	}
+	if dialer.WriteBufferPool != nil {
+		t.Error("the configured Dialer was modified")
+	}
+	conn, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	defer conn.Release()
+	if err := conn.SendMessage("hello"); err != nil {
+		t.Fatalf("SendMessage: %v", err)
+	}
+	if got, err := conn.ReadMessage(); err != nil || string(got) != "hello" {
+		t.Errorf("echo = %q, %v; want %q", got, err, "hello")
+	}
+}
+
+// countingBufferPool is a websocket.BufferPool that counts its use.
+type countingBufferPool struct {
+	gets, puts atomic.Int32
+}
+
+func (bp *countingBufferPool) Get() any {
+	bp.gets.Add(1)
+	return nil
+}
+
+func (bp *countingBufferPool) Put(any) {
+	bp.puts.Add(1)
+}
+
+func TestWriteBufferPool_UsedForWrites(t *testing.T) {
+	url := newEchoServer(t)
+	bp := &countingBufferPool{}
+	p := newPool(t, url, Config{MaxConn: 1, WriteBufferPool: bp})
+
+	conn, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	defer conn.Release()
+	if err := conn.SendMessage("hello"); err != nil {
+		t.Fatalf("SendMessage: %v", err)
+	}
+	if gets, puts := bp.gets.Load(), bp.puts.Load(); gets == 0 || puts != gets {
+		t.Errorf("WriteBufferPool: %d gets, %d puts; want a buffer taken and returned by the write", gets, puts)
+	}
+}
@@ -0,0 +1,52 @@
+package wspool
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// probeTimeout bounds a Probe whose context has no deadline.
+const probeTimeout = 5 * time.Second
+
+// errPong stops the probe read loop once the pong arrives.
+var errPong = errors.New("pong received")
+
+// Probe checks that the WebSocket endpoint at url is reachable, independently
+// of any Pool. It dials with dialer (websocket.DefaultDialer if nil), sends a
+// ping, waits for the pong and closes the connection again.
+func Probe(ctx context.Context, dialer *websocket.Dialer, url string, header http.Header) error {
+	if dialer == nil {
+		dialer = websocket.DefaultDialer
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(probeTimeout)
+	}
+
+	conn, _, err := dialer.DialContext(ctx, url, header)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.SetPongHandler(func(string) error { return errPong })
+	if err := conn.WriteControl(websocket.PingMessage, nil, deadline); err != nil {
+		return err
+	}
+	conn.SetReadDeadline(deadline)
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			if errors.Is(err, errPong) {
+				break
+			}
+			return err
+		}
+	}
+
+	return conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), deadline)
+}
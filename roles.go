@@ -0,0 +1,71 @@
+package wspool
+
+import "context"
+
+// AcquireReader is like Acquire but takes the connection from the reader
+// sub-pool sized by Config.MaxReaders, for long-lived reads such as
+// subscriptions. Without MaxReaders it is Acquire.
+func (p *Pool) AcquireReader(ctx context.Context) (*WsConn, error) {
+	if p.readers == nil {
+		return p.Acquire(ctx)
+	}
+	return p.readers.Acquire(ctx)
+}
+
+// AcquireWriter is like Acquire but takes the connection from the writer
+// sub-pool sized by Config.MaxWriters, for sending commands. Without
+// MaxWriters it is Acquire.
+func (p *Pool) AcquireWriter(ctx context.Context) (*WsConn, error) {
+	if p.writers == nil {
+		return p.Acquire(ctx)
+	}
+	return p.writers.Acquire(ctx)
+}
+
+// newRolePool creates a reader or writer sub-pool of p with max connections
+// sharing config, or returns nil if max is zero. Sub-pools dial on demand
+// and do not nest.
+func (p *Pool) newRolePool(config Config, max int32) (*Pool, error) {
+	if max == 0 {
+		return nil, nil
+	}
+	config.MaxConn = max
+	config.MinConn = 0
+	config.MinIdleConn = 0
+	config.MaxReaders = 0
+	config.MaxWriters = 0
+	return create(config, p)
+}
+
+// root returns the pool that owns p, or p itself if it is not a role
+// sub-pool.
+func (p *Pool) root() *Pool {
+	if p.parent != nil {
+		return p.parent
+	}
+	return p
+}
+
+// roles returns the reader and writer sub-pools that were configured.
+func (p *Pool) roles() []*Pool {
+	var roles []*Pool
+	for _, role := range []*Pool{p.readers, p.writers} {
+		if role != nil {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
+
+// forwardErrors relays the errors of a role sub-pool to the Errors channel
+// of p until p is closed.
+func (p *Pool) forwardErrors(role *Pool) {
+	for {
+		select {
+		case err := <-role.errs:
+			p.reportError(err)
+		case <-p.closeChan:
+			return
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package wspool
+
+import "slices"
+
+// idleStore holds a pool's idle connections and decides which one an
+// acquisition gets. Swapping the implementation changes the reuse order
+// without touching the acquire and release logic. It is only used with
+// p.lock held, so implementations need no locking of their own.
+type idleStore interface {
+	// Put adds a released connection.
+	Put(conn *WsConn)
+	// Get removes and returns the next connection, in the store's order,
+	// that satisfies match, or nil if there is none.
+	Get(match func(*WsConn) bool) *WsConn
+	// Remove removes conn, or another handle to the same connection, and
+	// reports whether it was stored.
+	Remove(conn *WsConn) bool
+	// Len returns the number of stored connections.
+	Len() int
+	// Range calls f for each stored connection, from the least to the most
+	// recently stored, until f returns false. f must not modify the store.
+	Range(f func(*WsConn) bool)
+}
+
+// lifoStore is the default idleStore, a slice that hands out the most
+// recently released connection first so that the rest can go idle and be
+// evicted.
+type lifoStore struct {
+	conns []*WsConn
+}
+
+func (s *lifoStore) Put(conn *WsConn) {
+	s.conns = append(s.conns, conn)
+}
+
+func (s *lifoStore) Get(match func(*WsConn) bool) *WsConn {
+	for i := len(s.conns) - 1; i >= 0; i-- {
+		if conn := s.conns[i]; match(conn) {
+			s.conns = slices.Delete(s.conns, i, i+1)
+			return conn
+		}
+	}
+	return nil
+}
+
+func (s *lifoStore) Remove(conn *WsConn) bool {
+	i := slices.IndexFunc(s.conns, func(c *WsConn) bool { return c.pooledConn == conn.pooledConn })
+	if i < 0 {
+		return false
+	}
+	s.conns = slices.Delete(s.conns, i, i+1)
+	return true
+}
+
+func (s *lifoStore) Len() int {
+	return len(s.conns)
+}
+
+func (s *lifoStore) Range(f func(*WsConn) bool) {
+	for _, conn := range s.conns {
+		if !f(conn) {
+			return
+		}
+	}
+}
+
+// idleConns returns a snapshot of the idle connections, least recently
+// stored first. Must be called with p.lock held.
+func (p *Pool) idleConns() []*WsConn {
+	conns := make([]*WsConn, 0, p.idle.Len())
+	p.idle.Range(func(conn *WsConn) bool {
+		conns = append(conns, conn)
+		return true
+	})
+	return conns
+}
+
+// removeOldestIdle removes and returns the least recently stored idle
+// connection, or nil if there is none. Must be called with p.lock held.
+func (p *Pool) removeOldestIdle() *WsConn {
+	var oldest *WsConn
+	p.idle.Range(func(conn *WsConn) bool {
+		oldest = conn
+		return false
+	})
+	if oldest != nil {
+		p.idle.Remove(oldest)
+	}
+	return oldest
+}
@@ -0,0 +1,38 @@
+package wspool
+
+import "fmt"
+
+// ReadJSONStream starts a goroutine that decodes every message received on
+// conn into a T and delivers it on the returned value channel. When a read or
+// decode fails, or a hook panics while reading, the error is delivered on the
+// error channel and both channels are closed.
+//
+// The stream owns reads on conn until it ends: the caller must keep draining
+// the value channel and must not read from conn concurrently.
+func ReadJSONStream[T any](conn *WsConn) (<-chan T, <-chan error) {
+	values := make(chan T)
+	errs := make(chan error, 1)
+
+	go func() {
+		defer close(values)
+		defer close(errs)
+		defer func() {
+			if v := recover(); v != nil {
+				if conn.p != nil {
+					conn.p.reportPanic(v)
+				}
+				errs <- fmt.Errorf("stream panicked: %v", v)
+			}
+		}()
+		for {
+			var v T
+			if err := conn.ReadJSON(&v); err != nil {
+				errs <- err
+				return
+			}
+			values <- v
+		}
+	}()
+
+	return values, errs
+}
@@ -0,0 +1,94 @@
+package wspool
+
+import (
+	"encoding/json"
+	"slices"
+
+	"github.com/gorilla/websocket"
+)
+
+// subscriptionMessage is the frame sent by Subscribe and Unsubscribe.
+type subscriptionMessage struct {
+	Action string `json:"action"`
+	Topic  string `json:"topic"`
+}
+
+// Subscribe subscribes the connection to topic by sending
+// {"action": "subscribe", "topic": topic} as a JSON text message, and
+// records the subscription so that it is sent again whenever the
+// connection is redialed after a retriable error. Subscribing to a topic
+// the connection is already subscribed to sends nothing.
+//
+// Subscriptions belong to the socket: they survive release and reacquire,
+// and are forgotten only when the connection is closed.
+func (w *WsConn) Subscribe(topic string) error {
+	if err := w.checkOwner(); err != nil {
+		return err
+	}
+	if slices.Contains(w.Subscriptions(), topic) {
+		return nil
+	}
+	if err := w.sendSubscription("subscribe", topic); err != nil {
+		return err
+	}
+	w.subsMu.Lock()
+	defer w.subsMu.Unlock()
+	if !slices.Contains(w.subs, topic) {
+		w.subs = append(w.subs, topic)
+	}
+	return nil
+}
+
+// Unsubscribe sends {"action": "unsubscribe", "topic": topic} and stops
+// restoring topic on reconnect. Unsubscribing from a topic the connection
+// is not subscribed to sends nothing.
+func (w *WsConn) Unsubscribe(topic string) error {
+	if err := w.checkOwner(); err != nil {
+		return err
+	}
+	if !slices.Contains(w.Subscriptions(), topic) {
+		return nil
+	}
+	if err := w.sendSubscription("unsubscribe", topic); err != nil {
+		return err
+	}
+	w.subsMu.Lock()
+	defer w.subsMu.Unlock()
+	if i := slices.Index(w.subs, topic); i >= 0 {
+		w.subs = slices.Delete(w.subs, i, i+1)
+	}
+	return nil
+}
+
+// Subscriptions returns the topics the connection is subscribed to, in the
+// order they were subscribed.
+func (w *WsConn) Subscriptions() []string {
+	w.subsMu.Lock()
+	defer w.subsMu.Unlock()
+	return slices.Clone(w.subs)
+}
+
+// sendSubscription sends one subscribe or unsubscribe frame.
+func (w *WsConn) sendSubscription(action, topic string) error {
+	data, err := json.Marshal(subscriptionMessage{Action: action, Topic: topic})
+	if err != nil {
+		return err
+	}
+	return w.sendFrame(websocket.TextMessage, data)
+}
+
+// restoreSubscriptions resends a subscribe frame for every recorded topic on
+// a freshly redialed socket.
+// Must be called with w.mu held and w.c non-nil.
+func (w *WsConn) restoreSubscriptions() error {
+	for _, topic := range w.Subscriptions() {
+		data, err := json.Marshal(subscriptionMessage{Action: "subscribe", Topic: topic})
+		if err != nil {
+			return err
+		}
+		if err := w.send(websocket.TextMessage, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}